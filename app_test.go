@@ -34,7 +34,7 @@ func TestApp_Run(t *testing.T) {
 			bytes.NewReader([]byte(cmds)),
 			buffer,
 			hex.EncodeToString,
-			NewFileSystemStorage(tempDir),
+			NewFileSystemStorage(tempDir, false),
 		)
 		app.Run(context.Background())
 		responsesCount := 0
@@ -145,6 +145,11 @@ func (t sleepingStorage) Put(ctx context.Context, request PutRequest) (string, e
 	return "", nil
 }
 
+func (t sleepingStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	time.Sleep(time.Millisecond)
+	return false, nil
+}
+
 func (t sleepingStorage) Close(ctx context.Context) error {
 	time.Sleep(time.Millisecond)
 	return nil
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// envelope header is magic, version, codec, level, uvarint of original size and uvarint of zstd dictionary ID,
+// then compressed body. Version 1 has no dictionary ID.
+// Values without the magic are legacy ones: headerless zstd or raw bodies.
+var (
+	envelopeMagic        = []byte("GCPZ")
+	errTruncatedEnvelope = fmt.Errorf("%w: truncated envelope", errCorruptedBody)
+)
+
+const envelopeVersion = 2
+
+type codecID byte
+
+const (
+	codecNone codecID = iota
+	codecZstd
+	codecS2
+	codecSnappy
+	codecGzip
+)
+
+var codecNames = map[string]codecID{
+	"none":   codecNone,
+	"zstd":   codecZstd,
+	"s2":     codecS2,
+	"snappy": codecSnappy,
+	"gzip":   codecGzip,
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+const (
+	//maxDecodedSize bounds the size claimed by stored values, which are not trusted
+	maxDecodedSize = 4 << 30
+	//maxPreallocRatio bounds the buffer allocated up front for the claimed size, larger bodies grow it while decoding
+	maxPreallocRatio = 64
+)
+
+type (
+	envelope struct {
+		codec codecID
+		level int8
+		size  uint64
+		dict  uint32
+	}
+	// codecs encodes and decodes bodies, keeping expensive zstd coders for reuse
+	codecs struct {
+		mu           sync.Mutex
+		dicts        map[uint32][]byte
+		zstdEncoders map[zstdEncoderKey]*zstd.Encoder
+		zstdDecoders map[uint32]*zstd.Decoder
+	}
+	zstdEncoderKey struct {
+		level int
+		dict  uint32
+	}
+)
+
+func parseCodec(name string) (codecID, error) {
+	id, ok := codecNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown codec: %s", name)
+	}
+	return id, nil
+}
+
+func newCodecs() *codecs {
+	return &codecs{
+		dicts:        map[uint32][]byte{},
+		zstdEncoders: map[zstdEncoderKey]*zstd.Encoder{},
+		zstdDecoders: map[uint32]*zstd.Decoder{0: must(zstd.NewReader(nil, zstdDecoderOptions()...))},
+	}
+}
+
+// addDict makes zstd dictionary with id available for encoding and decoding
+func (c *codecs) addDict(id uint32, d []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dicts[id] = d
+}
+
+func (c *codecs) hasDict(id uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.dicts[id]
+	return id == 0 || ok
+}
+
+// encode compresses src and prepends envelope, level 0 means codec default,
+// dict is ID of added zstd dictionary, 0 means none
+func (c *codecs) encode(codec codecID, level int, dict uint32, src []byte) ([]byte, error) {
+	if codec != codecZstd {
+		dict = 0
+	}
+	dst := appendEnvelope(nil, envelope{codec: codec, level: int8(level), size: uint64(len(src)), dict: dict})
+	switch codec {
+	case codecNone:
+		return append(dst, src...), nil
+	case codecZstd:
+		encoder, err := c.zstdEncoder(level, dict)
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(src, dst), nil
+	case codecS2, codecSnappy:
+		var body []byte
+		switch {
+		case codec == codecSnappy:
+			body = s2.EncodeSnappy(nil, src)
+		case level >= 3:
+			body = s2.EncodeBest(nil, src)
+		case level == 2:
+			body = s2.EncodeBetter(nil, src)
+		default:
+			body = s2.Encode(nil, src)
+		}
+		if uint64(len(src)) > uint64(len(body))*maxPreallocRatio {
+			//decode refuses s2 bodies claiming more than the ratio, such values are kept as zstd
+			return c.encode(codecZstd, 0, 0, src)
+		}
+		return append(dst, body...), nil
+	case codecGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		buffer := bytes.NewBuffer(dst)
+		writer, err := gzip.NewWriterLevel(buffer, level)
+		if err != nil {
+			return nil, err
+		}
+		_, err = writer.Write(src)
+		if err != nil {
+			return nil, err
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown codec: %d", codec)
+}
+
+// decode understands any codec and legacy values, a value not matching its envelope fails with errCorruptedBody
+func (c *codecs) decode(src []byte) ([]byte, error) {
+	env, body, ok, err := parseEnvelope(src)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if bytes.HasPrefix(src, zstdMagic) {
+			decoded, err := must(c.zstdDecoder(0)).DecodeAll(src, nil)
+			if err == nil {
+				return decoded, nil
+			}
+			//raw body which happens to start with zstd magic
+		}
+		return src, nil
+	}
+	if env.size > maxDecodedSize {
+		return nil, fmt.Errorf("%w: size %d is above limit", errCorruptedBody, env.size)
+	}
+	decoded, err := c.decodeBody(env, body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptedBody, err)
+	}
+	if uint64(len(decoded)) != env.size {
+		return nil, fmt.Errorf("%w: size %d, expected %d", errCorruptedBody, len(decoded), env.size)
+	}
+	return decoded, nil
+}
+
+func (c *codecs) decodeBody(env envelope, body []byte) ([]byte, error) {
+	dst := make([]byte, 0, min(env.size, uint64(len(body))*maxPreallocRatio))
+	switch env.codec {
+	case codecNone:
+		return body, nil
+	case codecZstd:
+		decoder, err := c.zstdDecoder(env.dict)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.DecodeAll(body, dst)
+	case codecS2, codecSnappy:
+		//s2 allocates the length from its own header in one go, so a tiny body must not claim a huge one
+		n, err := s2.DecodedLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(n) != env.size {
+			return nil, fmt.Errorf("s2 size %d, expected %d", n, env.size)
+		}
+		if uint64(n) > uint64(len(body))*maxPreallocRatio {
+			return nil, fmt.Errorf("s2 size %d is above %d times body size %d", n, maxPreallocRatio, len(body))
+		}
+		return s2.Decode(nil, body)
+	case codecGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		buffer := bytes.NewBuffer(dst)
+		//reading one byte past the size is enough to tell it does not match
+		_, err = io.Copy(buffer, io.LimitReader(reader, int64(env.size)+1))
+		if err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), reader.Close()
+	}
+	return nil, fmt.Errorf("unknown codec: %d", env.codec)
+}
+
+func (c *codecs) zstdEncoder(level int, dict uint32) (*zstd.Encoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := zstdEncoderKey{level: level, dict: dict}
+	encoder, ok := c.zstdEncoders[key]
+	if ok {
+		return encoder, nil
+	}
+	zstdLevel := zstd.SpeedDefault
+	if level != 0 {
+		zstdLevel = zstd.EncoderLevelFromZstd(level)
+	}
+	options := []zstd.EOption{zstd.WithEncoderLevel(zstdLevel), zstd.WithEncoderConcurrency(1)}
+	if dict != 0 {
+		d, ok := c.dicts[dict]
+		if !ok {
+			return nil, fmt.Errorf("dictionary %d: %w", dict, errDictNotFound)
+		}
+		options = append(options, zstd.WithEncoderDict(d))
+	}
+	encoder, err := zstd.NewWriter(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	c.zstdEncoders[key] = encoder
+	return encoder, nil
+}
+
+func (c *codecs) zstdDecoder(dict uint32) (*zstd.Decoder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decoder, ok := c.zstdDecoders[dict]
+	if ok {
+		return decoder, nil
+	}
+	d, ok := c.dicts[dict]
+	if !ok {
+		return nil, fmt.Errorf("dictionary %d: %w", dict, errDictNotFound)
+	}
+	decoder, err := zstd.NewReader(nil, append(zstdDecoderOptions(), zstd.WithDecoderDicts(d))...)
+	if err != nil {
+		return nil, err
+	}
+	c.zstdDecoders[dict] = decoder
+	return decoder, nil
+}
+
+func zstdDecoderOptions() []zstd.DOption {
+	return []zstd.DOption{zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecodedSize)}
+}
+
+func appendEnvelope(dst []byte, env envelope) []byte {
+	dst = append(dst, envelopeMagic...)
+	dst = append(dst, envelopeVersion, byte(env.codec), byte(env.level))
+	dst = binary.AppendUvarint(dst, env.size)
+	return binary.AppendUvarint(dst, uint64(env.dict))
+}
+
+// parseEnvelope returns false if src has no envelope
+func parseEnvelope(src []byte) (envelope, []byte, bool, error) {
+	if !bytes.HasPrefix(src, envelopeMagic) {
+		return envelope{}, nil, false, nil
+	}
+	src = src[len(envelopeMagic):]
+	if len(src) < 3 {
+		return envelope{}, nil, false, errTruncatedEnvelope
+	}
+	version := src[0]
+	if version != 1 && version != envelopeVersion {
+		return envelope{}, nil, false, fmt.Errorf("unsupported envelope version: %d", version)
+	}
+	env := envelope{codec: codecID(src[1]), level: int8(src[2])}
+	src = src[3:]
+	size, n := binary.Uvarint(src)
+	if n <= 0 {
+		return envelope{}, nil, false, errTruncatedEnvelope
+	}
+	env.size, src = size, src[n:]
+	if version == 1 {
+		return env, src, true, nil
+	}
+	dict, n := binary.Uvarint(src)
+	if n <= 0 || dict > math.MaxUint32 {
+		return envelope{}, nil, false, errTruncatedEnvelope
+	}
+	env.dict = uint32(dict)
+	return env, src[n:], true, nil
+}
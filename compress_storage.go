@@ -3,56 +3,153 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"sync"
+	"time"
 
-	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/compress/s2"
 )
 
+// compressStorage compresses bodies on the way to the decorated storage and decompresses them back,
+// meant to wrap external storage only, so files at DiskPath stay raw.
+// Stored values are self-describing, so entries written with any codec are readable.
+// Zstd uses the newest dictionary published to the decorated storage, if any.
 type compressStorage struct {
 	Storage
+	codecs     *codecs
+	codec      codecID
+	level      int
+	minRatio   float64
+	latestDict uint32
+	dictOnce   sync.Once
 }
 
-func NewCompressStorage(storage Storage) Storage {
-	return &compressStorage{Storage: storage}
+// sampleSize is how much of body is compressed to estimate ratio
+const sampleSize = 64 * 1024
+
+// NewCompressStorage compresses with codec at level, level 0 means codec default.
+// Bodies whose estimated compression ratio is below minRatio are stored raw, 0 compresses everything.
+func NewCompressStorage(storage Storage, codec codecID, level int, minRatio float64) Storage {
+	return &compressStorage{Storage: storage, codecs: newCodecs(), codec: codec, level: level, minRatio: minRatio}
 }
 
-func (c compressStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+func (c *compressStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
 	getResponse, ok, err := c.Storage.Get(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, ok, err
+	}
+	src, err := readBody(getResponse.Body)
+	if errors.Is(err, errCorruptedBody) {
+		//detected and reported by the decorated storage while streaming
+		return GetResponse{}, false, nil
+	}
 	if err != nil {
-		return GetResponse{}, false, err
+		return GetResponse{}, false, fmt.Errorf("get: read body: %w", err)
+	}
+	env, _, _, err := parseEnvelope(src)
+	if errors.Is(err, errCorruptedBody) {
+		return c.corrupted(key, err)
 	}
-	buffer := &bytes.Buffer{}
-	encoder, err := zstd.NewReader(buffer)
 	if err != nil {
-		return GetResponse{}, false, fmt.Errorf("get: zstd compressor: %w", err)
+		return GetResponse{}, false, fmt.Errorf("get: decompress: %w", err)
+	}
+	err = c.ensureDict(ctx, env.dict)
+	if errors.Is(err, errDictNotFound) {
+		//value is unreadable without its dictionary
+		fmt.Fprintf(os.Stderr, "compress: %s of %s\n", err, key)
+		return GetResponse{}, false, nil
 	}
-	_, err = io.Copy(buffer, encoder)
 	if err != nil {
-		return GetResponse{}, false, fmt.Errorf("get: zstd decompressor: %w", err)
+		return GetResponse{}, false, fmt.Errorf("get: load dictionary: %w", err)
+	}
+	now := time.Now()
+	body, err := c.codecs.decode(src)
+	if errors.Is(err, errCorruptedBody) {
+		return c.corrupted(key, err)
 	}
-	return getResponse, ok, err
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("get: decompress: %w", err)
+	}
+	compression.observeDecode(time.Since(now))
+	getResponse.Body = bytes.NewReader(body)
+	getResponse.BodySize = int64(len(body))
+	return getResponse, true, nil
+}
+
+// corrupted makes a value not matching its envelope a miss instead of failing the build
+func (c *compressStorage) corrupted(key string, err error) (GetResponse, bool, error) {
+	integrityFailures.Add(1)
+	fmt.Fprintf(os.Stderr, "compress: %s of %s\n", err, key)
+	return GetResponse{}, false, nil
 }
 
-func (c compressStorage) Put(ctx context.Context, request PutRequest) (string, error) {
-	buffer := &bytes.Buffer{}
-	encoder, err := zstd.NewWriter(buffer)
+func (c *compressStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	src, err := io.ReadAll(request.Body)
 	if err != nil {
-		return "", fmt.Errorf("put: zstd compressor: %w", err)
+		return "", fmt.Errorf("put: read body: %w", err)
 	}
-	defer encoder.Close()
-	_, err = io.Copy(encoder, request.Body)
+	c.dictOnce.Do(func() {
+		c.latestDict = c.loadLatestDict(ctx)
+	})
+	now := time.Now()
+	codec := c.codec
+	if !c.compressible(src) {
+		codec = codecNone
+	}
+	body, err := c.codecs.encode(codec, c.level, c.latestDict, src)
 	if err != nil {
-		return "", fmt.Errorf("put: zstd compressor: %w", err)
+		return "", fmt.Errorf("put: compress: %w", err)
 	}
+	compression.observeEncode(int64(len(src)), int64(len(body)), time.Since(now), codec == codecNone)
+	//storages see the size of what they store, get restores the raw size
 	return c.Storage.Put(ctx, PutRequest{
 		Key:      request.Key,
 		OutputID: request.OutputID,
-		Body:     buffer,
-		BodySize: request.BodySize,
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
 	})
 }
 
-func (c compressStorage) Close(ctx context.Context) error {
+// loadLatestDict returns ID of the newest published dictionary, 0 if there is none or it is unavailable
+func (c *compressStorage) loadLatestDict(ctx context.Context) uint32 {
+	if c.codec != codecZstd {
+		return 0
+	}
+	id, err := loadLatestDictID(ctx, c.Storage)
+	if err == nil {
+		err = c.ensureDict(ctx, id)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compress: compressing without dictionary: %s\n", err)
+		return 0
+	}
+	return id
+}
+
+func (c *compressStorage) ensureDict(ctx context.Context, id uint32) error {
+	if c.codecs.hasDict(id) {
+		return nil
+	}
+	d, err := loadDict(ctx, c.Storage, id)
+	if err != nil {
+		return err
+	}
+	c.codecs.addDict(id, d)
+	return nil
+}
+
+// compressible estimates ratio by fast compression of body sample
+func (c *compressStorage) compressible(src []byte) bool {
+	if c.minRatio <= 0 || c.codec == codecNone || len(src) == 0 {
+		return true
+	}
+	sample := src[:min(len(src), sampleSize)]
+	return float64(len(sample))/float64(len(s2.Encode(nil, sample))) >= c.minRatio
+}
+
+func (c *compressStorage) Close(ctx context.Context) error {
 	return c.Storage.Close(ctx)
 }
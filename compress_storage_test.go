@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func Test_CompressStorage(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		external := newMemoryStorage()
+		storage := NewCompressStorage(external, codecZstd, 0, 0)
+		body := strings.Repeat(must(randomString(100)), 100)
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := external.bodies["ActionID_1"]; len(stored) >= len(body) {
+			t.Fatalf("expected compressed body, got %d bytes", len(stored))
+		}
+		if stored := external.bodies["ActionID_1"]; external.index["ActionID_1"].Size != int64(len(stored)) {
+			t.Fatal("expected size of the stored body")
+		}
+		get, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected to be equal")
+		}
+		if get.BodySize != int64(len(body)) {
+			t.Fatal("expected raw body size")
+		}
+	})
+	t.Run("miss", func(t *testing.T) {
+		_, ok, err := NewCompressStorage(newMemoryStorage(), codecZstd, 0, 0).Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("expected to be missing")
+		}
+	})
+	t.Run("disk path stays raw behind decorator", func(t *testing.T) {
+		external := NewCompressStorage(newMemoryStorage(), codecZstd, 0, 0)
+		body := strings.Repeat("MinRana", 100)
+		_, err := external.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), external)
+		get, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(must(os.ReadFile(get.DiskPath))) != body {
+			t.Fatal("expected raw file at disk path")
+		}
+	})
+	t.Run("incompressible body is stored raw", func(t *testing.T) {
+		external := newMemoryStorage()
+		storage := NewCompressStorage(external, codecZstd, 0, 1.1)
+		body := must(io.ReadAll(io.LimitReader(rand.Reader, 10000)))
+		skipped := compression.Skipped
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: bytes.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env, _, ok, err := parseEnvelope(external.bodies["ActionID_1"])
+		if err != nil || !ok {
+			t.Fatal("expected envelope", err)
+		}
+		if env.codec != codecNone {
+			t.Fatal("expected to be stored raw")
+		}
+		if compression.Skipped-skipped != 1 {
+			t.Fatal("expected skip to be counted")
+		}
+		get, _, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(must(io.ReadAll(get.Body)), body) {
+			t.Fatal("expected to be equal")
+		}
+	})
+}
+
+func Test_Dictionary(t *testing.T) {
+	d := trainTestDict(t)
+	external := newMemoryStorage()
+	id, err := publishDict(context.Background(), external, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"ImportPath":"example.com/pkg1000","GoFiles":["a1000.go"],"Compiler":"gc","Standard":false,"PackageFile":1000}`
+	_, err = NewCompressStorage(external, codecZstd, 0, 0).Put(context.Background(), PutRequest{
+		Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, _, _, err := parseEnvelope(external.bodies["ActionID_1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.dict != id {
+		t.Fatalf("expected dictionary %d, got %d", id, env.dict)
+	}
+	get, ok, err := NewCompressStorage(external, codecZstd, 0, 0).Get(context.Background(), "ActionID_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected to be found")
+	}
+	if string(must(io.ReadAll(get.Body))) != body {
+		t.Fatal("expected to be equal")
+	}
+}
+
+// trainTestDict trains a dictionary on bodies alike go list output
+func trainTestDict(t *testing.T) []byte {
+	dir := t.TempDir()
+	storage := NewFileSystemStorage(dir, false)
+	for i := range 500 {
+		body := fmt.Sprintf(`{"ImportPath":"example.com/pkg%d","GoFiles":["a%d.go"],"Compiler":"gc","Standard":false,"PackageFile":%d}`, i, i, i)
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key: fmt.Sprintf("ActionID_%d", i), OutputID: []byte(fmt.Sprintf("OutputID_%d", i)), Body: strings.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return must(trainDict(dir, 4096, 1000, maxDictSampleSize))
+}
+
+func Test_Codecs(t *testing.T) {
+	body := []byte(strings.Repeat(must(randomString(100)), 100))
+	t.Run("round trip", func(t *testing.T) {
+		c := newCodecs()
+		for name, codec := range codecNames {
+			for _, level := range []int{0, 1, 3, 9} {
+				encoded, err := c.encode(codec, level, 0, body)
+				if err != nil {
+					t.Fatal(name, level, err)
+				}
+				decoded, err := c.decode(encoded)
+				if err != nil {
+					t.Fatal(name, level, err)
+				}
+				if !bytes.Equal(decoded, body) {
+					t.Fatal("expected to be equal", name, level)
+				}
+			}
+		}
+	})
+	t.Run("codec is changed without flushing", func(t *testing.T) {
+		external := newMemoryStorage()
+		_, err := NewCompressStorage(external, codecGzip, 0, 0).Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: bytes.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get, _, err := NewCompressStorage(external, codecS2, 0, 0).Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(must(io.ReadAll(get.Body)), body) {
+			t.Fatal("expected to be equal")
+		}
+	})
+	t.Run("legacy values", func(t *testing.T) {
+		c := newCodecs()
+		legacy := must(zstd.NewWriter(nil)).EncodeAll(body, nil)
+		for _, src := range [][]byte{legacy, body} {
+			decoded, err := c.decode(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, body) {
+				t.Fatal("expected to be equal")
+			}
+		}
+	})
+	t.Run("raw value starting with zstd magic", func(t *testing.T) {
+		raw := append(append([]byte{}, zstdMagic...), body...)
+		decoded, err := newCodecs().decode(raw)
+		if err != nil || !bytes.Equal(decoded, raw) {
+			t.Fatal("expected to be passed through", err)
+		}
+	})
+	t.Run("value not matching its envelope is corrupted", func(t *testing.T) {
+		c := newCodecs()
+		for name, codec := range codecNames {
+			encoded := must(c.encode(codec, 0, 0, body))
+			env, compressed, _, _ := parseEnvelope(encoded)
+			for _, size := range []uint64{env.size - 1, env.size + 1, 1 << 40, math.MaxUint64} {
+				env.size = size
+				_, err := c.decode(append(appendEnvelope(nil, env), compressed...))
+				if !errors.Is(err, errCorruptedBody) {
+					t.Fatal("expected corrupted body", name, size, err)
+				}
+			}
+			_, err := c.decode(encoded[:len(encoded)/2])
+			if !errors.Is(err, errCorruptedBody) {
+				t.Fatal("expected corrupted body of truncated value", name, err)
+			}
+		}
+	})
+	t.Run("tiny s2 body claiming large size is corrupted", func(t *testing.T) {
+		c := newCodecs()
+		for _, codec := range []codecID{codecS2, codecSnappy} {
+			const size = 1 << 31
+			//s2 block is uvarint of decoded size followed by literals
+			value := appendEnvelope(nil, envelope{codec: codec, size: size})
+			value = append(binary.AppendUvarint(value, size), 0, 'x')
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := c.decode(value)
+			runtime.ReadMemStats(&after)
+			if !errors.Is(err, errCorruptedBody) {
+				t.Fatal("expected corrupted body", codec, err)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+				t.Fatal("allocated claimed size", codec, allocated)
+			}
+		}
+	})
+	t.Run("highly compressible s2 value round trips", func(t *testing.T) {
+		c := newCodecs()
+		zeros := make([]byte, 1<<20)
+		for level := range 4 {
+			if !bytes.Equal(must(c.decode(must(c.encode(codecS2, level, 0, zeros)))), zeros) {
+				t.Fatal("round trip failed", level)
+			}
+		}
+	})
+	t.Run("corrupted value is a miss", func(t *testing.T) {
+		external := newMemoryStorage()
+		env := appendEnvelope(nil, envelope{codec: codecS2, size: math.MaxUint64})
+		must(external.Put(context.Background(), PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: bytes.NewReader(env)}))
+		_, ok, err := NewCompressStorage(external, codecS2, 0, 0).Get(context.Background(), "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+}
+
+func FuzzDecode(f *testing.F) {
+	c := newCodecs()
+	body := []byte(strings.Repeat("hello", 100))
+	for _, codec := range codecNames {
+		f.Add(must(c.encode(codec, 0, 0, body)))
+	}
+	f.Add(must(zstd.NewWriter(nil)).EncodeAll(body, nil))
+	f.Fuzz(func(t *testing.T, src []byte) {
+		//must not panic or allocate the size claimed by the value
+		c.decode(src)
+	})
+}
+
+// memoryStorage is an in-memory external storage
+type memoryStorage struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+	index  map[string]index
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{bodies: map[string][]byte{}, index: map[string]index{}}
+}
+
+func (m *memoryStorage) Get(_ context.Context, key string) (GetResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ind, ok := m.index[key]
+	if !ok {
+		return GetResponse{}, false, nil
+	}
+	return GetResponse{OutputID: ind.OutputID, BodySize: ind.Size, Body: bytes.NewReader(m.bodies[key])}, true, nil
+}
+
+func (m *memoryStorage) Put(_ context.Context, request PutRequest) (string, error) {
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bodies[request.Key] = body
+	m.index[request.Key] = index{OutputID: request.OutputID, Size: request.BodySize}
+	return "", nil
+}
+
+func (m *memoryStorage) Has(_ context.Context, key string, outputID []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ind, ok := m.index[key]
+	return ok && bytes.Equal(ind.OutputID, outputID), nil
+}
+
+func (m *memoryStorage) Close(context.Context) error {
+	return nil
+}
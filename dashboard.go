@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	statsInterval = time.Minute
+	//statsHistory is an hour of per-minute samples
+	statsHistory      = 60
+	statsTopN         = 10
+	statsRecentErrors = 20
+	//statsMaxClients bounds memory of client stats, further clients are counted as otherClient
+	statsMaxClients = 1024
+	otherClient     = "other"
+)
+
+type (
+	// serverStats collects what the dashboard shows beyond counters of the metrics decorator and expvar
+	serverStats struct {
+		metrics  *metrics
+		evicting *evictingStorage
+		started  time.Time
+		mu       sync.Mutex
+		clients  map[string]*clientStats
+		errors   []serveError
+		history  []statsSample
+		last     metricsSnapshot
+	}
+	clientStats struct {
+		Client        string
+		Requests      int64
+		Hits          int64
+		Misses        int64
+		Puts          int64
+		BytesSent     int64
+		BytesReceived int64
+	}
+	serveError struct {
+		Time   time.Time
+		Client string
+		Method string
+		Key    string
+		Error  string
+	}
+	// statsSample holds operations done during statsInterval before Time
+	statsSample struct {
+		Time   time.Time
+		Gets   int64
+		Misses int64
+		Puts   int64
+		Errors int64
+	}
+	dirStats struct {
+		Size    int64
+		MaxSize int64
+		Entries int64
+		Bodies  int64
+		Largest []cacheEntry
+	}
+	cacheEntry struct {
+		Name    string
+		Size    int64
+		ModTime time.Time
+	}
+	statsResponse struct {
+		Started  time.Time
+		Uptime   time.Duration
+		Storage  metricsSnapshot
+		Dir      dirStats
+		Counters map[string]int64
+		History  []statsSample
+		Clients  []clientStats
+		Errors   []serveError
+	}
+	// statusWriter remembers status and size of a response
+	statusWriter struct {
+		http.ResponseWriter
+		status  int
+		written int64
+	}
+)
+
+func newServerStats(metrics *metrics, evicting *evictingStorage) *serverStats {
+	return &serverStats{
+		metrics:  metrics,
+		evicting: evicting,
+		started:  time.Now(),
+		clients:  map[string]*clientStats{},
+		last:     metrics.snapshot(),
+	}
+}
+
+// run samples metrics every statsInterval until ctx is done
+func (s *serverStats) run(ctx context.Context) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.sample(now)
+		}
+	}
+}
+
+// sample appends operations done since the previous sample to history
+func (s *serverStats) sample(now time.Time) {
+	snapshot := s.metrics.snapshot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, statsSample{
+		Time:   now,
+		Gets:   snapshot.Gets - s.last.Gets,
+		Misses: snapshot.Misses - s.last.Misses,
+		Puts:   snapshot.Puts - s.last.Puts,
+		Errors: snapshot.Errors - s.last.Errors,
+	})
+	s.history = s.history[max(len(s.history)-statsHistory, 0):]
+	s.last = snapshot
+}
+
+// observe accounts finished request to its client, nil stats of peers ignore it
+func (s *serverStats) observe(r *http.Request, w *statusWriter) {
+	if s == nil {
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[client]
+	if !ok {
+		if len(s.clients) >= statsMaxClients {
+			client = otherClient
+			c = s.clients[client]
+		}
+		if c == nil {
+			c = &clientStats{Client: client}
+			s.clients[client] = c
+		}
+	}
+	c.Requests++
+	switch {
+	case r.Method == http.MethodGet && w.status == http.StatusOK:
+		c.Hits++
+		c.BytesSent += w.written
+	case r.Method == http.MethodGet && w.status == http.StatusNotFound:
+		c.Misses++
+	case r.Method == http.MethodPut && w.status == http.StatusNoContent:
+		c.Puts++
+		c.BytesReceived += r.ContentLength
+	}
+}
+
+// fail remembers error of a request, only the recent ones are kept
+func (s *serverStats) fail(r *http.Request, key string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, serveError{Time: time.Now(), Client: r.RemoteAddr, Method: r.Method, Key: key, Error: err.Error()})
+	s.errors = s.errors[max(len(s.errors)-statsRecentErrors, 0):]
+}
+
+func (s *serverStats) collect() statsResponse {
+	resp := statsResponse{
+		Started:  s.started,
+		Uptime:   time.Since(s.started).Round(time.Second),
+		Storage:  s.metrics.snapshot(),
+		Dir:      s.evicting.dirStats(),
+		Counters: counters(),
+		Clients:  []clientStats{},
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp.History = append([]statsSample{}, s.history...)
+	resp.Errors = append([]serveError{}, s.errors...)
+	for _, c := range s.clients {
+		resp.Clients = append(resp.Clients, *c)
+	}
+	sort.Slice(resp.Clients, func(i, j int) bool { return resp.Clients[i].Requests > resp.Clients[j].Requests })
+	resp.Clients = resp.Clients[:min(len(resp.Clients), statsTopN)]
+	return resp
+}
+
+func (s *serverStats) serveStats(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.collect())
+}
+
+// counters returns expvar counters, leaving out variables such as cmdline which may hold secrets
+func counters() map[string]int64 {
+	result := map[string]int64{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if counter, ok := kv.Value.(*expvar.Int); ok {
+			result[kv.Key] = counter.Value()
+		}
+	})
+	return result
+}
+
+func serveCounters(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(counters())
+}
+
+func (s *serverStats) serveDashboard(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardPage))
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom lets bodies served from disk keep sendfile of the underlying writer
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.written += n
+	return n, err
+}
+
+// Unwrap is used by http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// dashboardPage renders /stats, refreshing every 10 seconds
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gocacheprog</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+.tiles { display: flex; flex-wrap: wrap; gap: 1em; }
+.tile { border: 1px solid #ccc; border-radius: 4px; padding: 0.5em 1em; min-width: 8em; }
+.tile b { display: block; font-size: 1.5em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+td, th { border-bottom: 1px solid #eee; padding: 0.2em 1em; text-align: left; }
+#chart rect.hit { fill: #4a4; } #chart rect.miss { fill: #d44; }
+</style>
+</head>
+<body>
+<h1>gocacheprog</h1>
+<div class="tiles" id="tiles"></div>
+<h2>Hits and misses per minute</h2>
+<svg id="chart" width="720" height="120"></svg>
+<h2>Largest entries</h2>
+<table id="largest"></table>
+<h2>Top clients</h2>
+<table id="clients"></table>
+<h2>Recent errors</h2>
+<table id="errors"></table>
+<script>
+function size(b) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  for (; b >= 1024 && i < units.length - 1; i++) b /= 1024;
+  return b.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+function ms(ns) { return (ns / 1e6).toFixed(1) + ' ms'; }
+function table(id, head, rows) {
+  const t = document.getElementById(id);
+  t.replaceChildren();
+  for (const row of [head, ...rows]) {
+    const tr = t.insertRow();
+    for (const v of row) {
+      const cell = document.createElement(row === head ? 'th' : 'td');
+      cell.textContent = v;
+      tr.appendChild(cell);
+    }
+  }
+}
+function render(s) {
+  const gets = s.Storage.Gets, hits = gets - s.Storage.Misses;
+  const tiles = {
+    'Size': size(s.Dir.Size) + (s.Dir.MaxSize ? ' of ' + size(s.Dir.MaxSize) : ''),
+    'Entries': s.Dir.Entries,
+    'Bodies': s.Dir.Bodies,
+    'Hit rate': gets ? (100 * hits / gets).toFixed(1) + '%' : 'N/A',
+    'Gets': gets,
+    'Puts': s.Storage.Puts,
+    'Errors': s.Storage.Errors,
+    'Avg get': ms(s.Storage.GetAvgTime),
+    'Avg put': ms(s.Storage.PutAvgTime),
+    'Sent': size(s.Counters.serve_bytes_sent || 0),
+    'Received': size(s.Counters.serve_bytes_received || 0),
+    'Evicted': size(s.Counters.serve_evicted_bytes || 0),
+  };
+  const el = document.getElementById('tiles');
+  el.replaceChildren();
+  for (const [k, v] of Object.entries(tiles)) {
+    const d = document.createElement('div'), b = document.createElement('b');
+    d.className = 'tile';
+    b.textContent = v;
+    d.append(k, b);
+    el.appendChild(d);
+  }
+  const chart = document.getElementById('chart'), w = 12;
+  chart.replaceChildren();
+  const top = Math.max(1, ...s.History.map(h => h.Gets));
+  s.History.forEach((h, i) => {
+    for (const [cls, n, y] of [['hit', h.Gets - h.Misses, h.Misses], ['miss', h.Misses, 0]]) {
+      const r = document.createElementNS('http://www.w3.org/2000/svg', 'rect');
+      const height = 120 * n / top;
+      r.setAttribute('class', cls);
+      r.setAttribute('x', i * w);
+      r.setAttribute('y', 120 - height - 120 * y / top);
+      r.setAttribute('width', w - 2);
+      r.setAttribute('height', height);
+      const title = document.createElementNS('http://www.w3.org/2000/svg', 'title');
+      title.textContent = new Date(h.Time).toLocaleTimeString() + ': ' + n + ' ' + cls + (n === 1 ? '' : cls === 'hit' ? 's' : 'es');
+      r.appendChild(title);
+      chart.appendChild(r);
+    }
+  });
+  table('largest', ['Body', 'Size', 'Last used'], s.Dir.Largest.map(e => [e.Name, size(e.Size), new Date(e.ModTime).toLocaleString()]));
+  table('clients', ['Client', 'Requests', 'Hits', 'Misses', 'Puts', 'Sent', 'Received'],
+    s.Clients.map(c => [c.Client, c.Requests, c.Hits, c.Misses, c.Puts, size(c.BytesSent), size(c.BytesReceived)]));
+  table('errors', ['Time', 'Client', 'Request', 'Error'],
+    s.Errors.slice().reverse().map(e => [new Date(e.Time).toLocaleString(), e.Client, e.Method + ' ' + e.Key, e.Error]));
+}
+function refresh() {
+  fetch('stats').then(r => r.json()).then(render).catch(console.error);
+}
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
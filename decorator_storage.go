@@ -3,12 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 )
 
+var (
+	remoteUploadSkips      = expvar.NewInt("remote_upload_skips")
+	remoteUploadBytesSaved = expvar.NewInt("remote_upload_bytes_saved")
+)
+
 // use one storage to save to disk and one to the external storage
 type decoratorStorage struct {
 	fileSystemStorage Storage
@@ -39,12 +46,18 @@ func (s *decoratorStorage) Get(ctx context.Context, key string) (GetResponse, bo
 	if getResponse.Body == nil {
 		return GetResponse{}, false, fmt.Errorf("empty getResponse.Body %s", key)
 	}
+	//released in case Put did not read it to the end
+	defer discardBody(getResponse.Body)
 	_, err = s.fileSystemStorage.Put(ctx, PutRequest{
 		Key:      key,
 		OutputID: getResponse.OutputID,
 		Body:     getResponse.Body,
 		BodySize: getResponse.BodySize,
 	})
+	if errors.Is(err, errCorruptedBody) {
+		//detected while streaming, nothing was stored
+		return GetResponse{}, false, nil
+	}
 	if err != nil {
 		return GetResponse{}, false, fmt.Errorf("failed to store response: %w", err)
 	}
@@ -60,9 +73,19 @@ func (s *decoratorStorage) Put(ctx context.Context, request PutRequest) (string,
 	s.wg.Add(1)
 	go func(request PutRequest) {
 		defer s.wg.Done()
-		request.Body = bytes.NewReader(bodyBytes)
-		_, err := s.externalStorage.Put(ctx, request)
+		//another runner may have already uploaded the same entry
+		has, err := s.externalStorage.Has(ctx, request.Key, request.OutputID)
 		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not check external response: %s\n", err)
+		}
+		if has {
+			remoteUploadSkips.Add(1)
+			remoteUploadBytesSaved.Add(request.BodySize)
+			return
+		}
+		request.Body = bytes.NewReader(bodyBytes)
+		_, err = s.externalStorage.Put(ctx, request)
+		if err != nil && !errors.Is(err, errPutDropped) {
 			fmt.Fprintf(os.Stderr, "could not store external response: %s\n", err)
 		}
 	}(request)
@@ -76,6 +99,14 @@ func (s *decoratorStorage) Put(ctx context.Context, request PutRequest) (string,
 	return diskPath, nil
 }
 
+func (s *decoratorStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	has, err := s.fileSystemStorage.Has(ctx, key, outputID)
+	if err != nil || has {
+		return has, err
+	}
+	return s.externalStorage.Has(ctx, key, outputID)
+}
+
 func (s *decoratorStorage) Close(ctx context.Context) error {
 	s.wg.Wait()
 	err1 := s.fileSystemStorage.Close(ctx)
@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
+	"io"
 	"strings"
 	"testing"
 
@@ -17,7 +19,7 @@ func Test_DecoratorStorage(t *testing.T) {
 		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
 
 		storage := NewDecoratorStorage(
-			NewFileSystemStorage(t.TempDir()),
+			NewFileSystemStorage(t.TempDir(), false),
 			externalStorage,
 		)
 		get, ok, err := storage.Get(context.Background(), "fOwaAFKWb")
@@ -42,7 +44,7 @@ func Test_DecoratorStorage(t *testing.T) {
 			Return(GetResponse{OutputID: []byte("MinRana"), Body: strings.NewReader("")}, true, nil).Times(1)
 		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
 
-		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir()), externalStorage)
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), externalStorage)
 		get, ok, err := storage.Get(context.Background(), "fOwaAFKWb")
 		if err != nil {
 			t.Fatal(err)
@@ -65,7 +67,7 @@ func Test_DecoratorStorage(t *testing.T) {
 			Return(GetResponse{}, false, fmt.Errorf("LihuaJones")).Times(1)
 		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
 
-		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir()), externalStorage)
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), externalStorage)
 		_, ok, err := storage.Get(context.Background(), "fOwaAFKWb")
 		if err == nil {
 			t.Fatal("expected to be err")
@@ -82,11 +84,13 @@ func Test_DecoratorStorage(t *testing.T) {
 		const key = "fOwaAFKWb"
 		ctrl := gomock.NewController(t)
 		externalStorage := NewMockStorage(ctrl)
+		externalStorage.EXPECT().Has(gomock.Any(), key, []byte("MinRana")).
+			Return(false, nil).Times(1)
 		externalStorage.EXPECT().Put(gomock.Any(), gomock.Any()).
 			Return("", nil).Times(1)
 		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
 
-		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir()), externalStorage)
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), externalStorage)
 		diskPath, err := storage.Put(context.Background(), PutRequest{
 			Key:      key,
 			OutputID: []byte("MinRana"),
@@ -113,11 +117,102 @@ func Test_DecoratorStorage(t *testing.T) {
 			t.Fatal(err)
 		}
 	})
+	t.Run("put skips upload if external storage has entry", func(t *testing.T) {
+		const key = "fOwaAFKWb"
+		ctrl := gomock.NewController(t)
+		externalStorage := NewMockStorage(ctrl)
+		externalStorage.EXPECT().Has(gomock.Any(), key, []byte("MinRana")).
+			Return(true, nil).Times(1)
+		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
+
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), externalStorage)
+		skips := remoteUploadSkips.Value()
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key:      key,
+			OutputID: []byte("MinRana"),
+			Body:     strings.NewReader(must(randomString(100))),
+			BodySize: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = storage.Close(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remoteUploadSkips.Value()-skips < 1 {
+			t.Fatal("expected upload to be skipped")
+		}
+	})
+	t.Run("read-only external storage drops put", func(t *testing.T) {
+		const key = "fOwaAFKWb"
+		ctrl := gomock.NewController(t)
+		externalStorage := NewMockStorage(ctrl)
+		//neither Has nor Put reach the external storage
+		externalStorage.EXPECT().Close(gomock.Any()).Return(nil).Times(1)
+
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), NewReadOnlyStorage(externalStorage))
+		diskPath, err := storage.Put(context.Background(), PutRequest{
+			Key:      key,
+			OutputID: []byte("MinRana"),
+			Body:     strings.NewReader(must(randomString(100))),
+			BodySize: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diskPath == "" {
+			t.Fatal("expected disk path")
+		}
+		err = storage.Close(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("corrupted download behind wrappers is a miss", func(t *testing.T) {
+		_, signer := must2(ed25519.GenerateKey(nil))
+		wrappers := map[string]func(Storage) Storage{
+			"compress": func(s Storage) Storage { return NewCompressStorage(s, codecZstd, 0, 0) },
+			"encrypt": func(s Storage) Storage {
+				return NewEncryptStorage(s, must(loadKeyring(strings.NewReader("key AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"))))
+			},
+			"sign": func(s Storage) Storage {
+				return NewSignStorage(s, signer, []ed25519.PublicKey{signer.Public().(ed25519.PublicKey)})
+			},
+		}
+		for name, wrap := range wrappers {
+			external := corruptingStorage{newMemoryStorage()}
+			_, err := wrap(external.Storage).Put(context.Background(), PutRequest{
+				Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5,
+			})
+			if err != nil {
+				t.Fatal(name, err)
+			}
+			storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), wrap(external))
+			_, ok, err := storage.Get(context.Background(), "ActionID_1")
+			if err != nil || ok {
+				t.Fatal("expected miss", name, err)
+			}
+		}
+	})
+}
+
+// corruptingStorage streams bodies the way remote storages do, failing them as not matching their hash
+type corruptingStorage struct {
+	Storage
+}
+
+func (c corruptingStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	resp, ok, err := c.Storage.Get(ctx, key)
+	if ok {
+		resp.Body = &streamBody{storage: "corrupting", key: key, body: io.NopCloser(resp.Body), hash: newContentHash(), expected: []byte("unexpected")}
+	}
+	return resp, ok, err
 }
 
 func Benchmark_DecoratorStorage(b *testing.B) {
 	b.Run("put", func(b *testing.B) {
-		storage := NewDecoratorStorage(NewFileSystemStorage(b.TempDir()), sleepingStorage{})
+		storage := NewDecoratorStorage(NewFileSystemStorage(b.TempDir(), false), sleepingStorage{})
 		request := PutRequest{
 			Key:      "dcd3McUV",
 			OutputID: []byte("MinRana"),
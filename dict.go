@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// dictionaries are stored in external storage as regular entries under these keys,
+// which never collide with hex ActionIDs
+const (
+	dictLatestKey = "zstd-dict-latest"
+	dictKeyPrefix = "zstd-dict-"
+)
+
+// isDictKey reports whether key holds a dictionary or the newest ID, storages keep them without TTL,
+// as entries compressed with a dictionary are unreadable without it however long they live
+func isDictKey(key string) bool {
+	return strings.HasPrefix(key, dictKeyPrefix)
+}
+
+func dictKey(id uint32) string {
+	return dictKeyPrefix + strconv.FormatUint(uint64(id), 10)
+}
+
+// trainDict builds zstd dictionary of up to dictSize bytes from bodies in local cache dir,
+// sampling at most samples bodies not larger than maxSampleSize
+func trainDict(dir string, dictSize, samples int, maxSampleSize int64) ([]byte, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	rand.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	var input [][]byte
+	for _, entry := range entries {
+		if len(input) >= samples {
+			break
+		}
+		if !strings.HasSuffix(entry.Name(), "-d") && !strings.HasSuffix(entry.Name(), "-o") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || info.Size() == 0 || info.Size() > maxSampleSize {
+			continue
+		}
+		body, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		input = append(input, body)
+	}
+	if len(input) == 0 {
+		return nil, fmt.Errorf("no samples found in %s", dir)
+	}
+	return dict.BuildZstdDict(input, dict.Options{MaxDictSize: dictSize, HashBytes: 6, ZstdLevel: zstd.SpeedDefault})
+}
+
+// publishDict stores dictionary under its ID and makes it the newest one
+func publishDict(ctx context.Context, storage Storage, d []byte) (uint32, error) {
+	info, err := zstd.InspectDictionary(d)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dictionary: %w", err)
+	}
+	id := info.ID()
+	_, err = storage.Put(ctx, PutRequest{
+		Key:      dictKey(id),
+		OutputID: contentHash(d),
+		Body:     bytes.NewReader(d),
+		BodySize: int64(len(d)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to store dictionary: %w", err)
+	}
+	latest := []byte(strconv.FormatUint(uint64(id), 10))
+	_, err = storage.Put(ctx, PutRequest{
+		Key:      dictLatestKey,
+		OutputID: contentHash(latest),
+		Body:     bytes.NewReader(latest),
+		BodySize: int64(len(latest)),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to store latest dictionary id: %w", err)
+	}
+	return id, nil
+}
+
+// loadLatestDictID returns 0 if no dictionary is published
+func loadLatestDictID(ctx context.Context, storage Storage) (uint32, error) {
+	body, ok, err := loadEntry(ctx, storage, dictLatestKey)
+	if err != nil || !ok {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(string(body), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid latest dictionary id: %w", err)
+	}
+	return uint32(id), nil
+}
+
+func loadDict(ctx context.Context, storage Storage, id uint32) ([]byte, error) {
+	body, ok, err := loadEntry(ctx, storage, dictKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("dictionary %d: %w", id, errDictNotFound)
+	}
+	return body, nil
+}
+
+var errDictNotFound = errors.New("dictionary not found")
+
+func loadEntry(ctx context.Context, storage Storage, key string) ([]byte, bool, error) {
+	getResponse, ok, err := storage.Get(ctx, key)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	if getResponse.Body == nil {
+		return nil, false, fmt.Errorf("empty body %s", key)
+	}
+	body, err := readBody(getResponse.Body)
+	if errors.Is(err, errCorruptedBody) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return body, true, nil
+}
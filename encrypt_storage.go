@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encrypted value is magic, version, key ID length, key ID, nonce, then AES-256-GCM ciphertext
+// of uvarint OutputID length, OutputID, uvarint body size and body
+var encryptMagic = []byte("GCPE")
+
+const encryptVersion = 1
+
+type (
+	// encryptStorage encrypts bodies and OutputIDs on the way to the decorated storage and decrypts them back,
+	// meant to wrap external storage only, so files at DiskPath stay plaintext.
+	// Decorated storage sees OutputIDs blinded with HMAC, so equal outputs still share blobs.
+	encryptStorage struct {
+		Storage
+		keys *keyring
+	}
+	// keyring holds keys by ID, the first one encrypts, all of them decrypt, so keys can be rotated
+	keyring struct {
+		activeID string
+		aeads    map[string]cipher.AEAD
+		blindKey []byte
+	}
+)
+
+func NewEncryptStorage(storage Storage, keys *keyring) Storage {
+	return &encryptStorage{Storage: storage, keys: keys}
+}
+
+func (e encryptStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	getResponse, ok, err := e.Storage.Get(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, ok, err
+	}
+	src, err := readBody(getResponse.Body)
+	if errors.Is(err, errCorruptedBody) {
+		//detected and reported by the decorated storage while streaming
+		return GetResponse{}, false, nil
+	}
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("get: read body: %w", err)
+	}
+	outputID, body, err := e.keys.open(src, getResponse.OutputID)
+	if err != nil {
+		//plaintext or foreign entries are not trusted
+		fmt.Fprintf(os.Stderr, "encrypt: %s of %s\n", err, key)
+		return GetResponse{}, false, nil
+	}
+	return GetResponse{
+		OutputID: outputID,
+		DiskPath: getResponse.DiskPath,
+		BodySize: int64(len(body)),
+		Body:     bytes.NewReader(body),
+	}, true, nil
+}
+
+func (e encryptStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	src, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("put: read body: %w", err)
+	}
+	blindID := e.keys.blind(request.OutputID)
+	body, err := e.keys.seal(request.OutputID, src, blindID)
+	if err != nil {
+		return "", fmt.Errorf("put: encrypt: %w", err)
+	}
+	return e.Storage.Put(ctx, PutRequest{
+		Key:      request.Key,
+		OutputID: blindID,
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	})
+}
+
+func (e encryptStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	return e.Storage.Has(ctx, key, e.keys.blind(outputID))
+}
+
+func (e encryptStorage) Close(ctx context.Context) error {
+	return e.Storage.Close(ctx)
+}
+
+// loadKeyring parses lines of key ID and base64 of 32 bytes key, separated by space,
+// empty lines and lines starting with # are skipped
+func loadKeyring(r io.Reader) (*keyring, error) {
+	keys := &keyring{aeads: map[string]cipher.AEAD{}}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, " ")
+		if !ok || len(id) > 255 {
+			return nil, fmt.Errorf("invalid key line: %s", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid key %s: expected 32 bytes, got %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		keys.aeads[id] = must(cipher.NewGCM(block))
+		if keys.activeID == "" {
+			keys.activeID = id
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte("gocacheprog blind output id"))
+			keys.blindKey = mac.Sum(nil)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if keys.activeID == "" {
+		return nil, errors.New("no keys found")
+	}
+	return keys, nil
+}
+
+func (k *keyring) blind(outputID []byte) []byte {
+	mac := hmac.New(sha256.New, k.blindKey)
+	mac.Write(outputID)
+	return mac.Sum(nil)
+}
+
+// seal encrypts outputID and body with active key, binding them to blinded OutputID the value is stored with
+func (k *keyring) seal(outputID, body, blindID []byte) ([]byte, error) {
+	aead := k.aeads[k.activeID]
+	dst := append([]byte{}, encryptMagic...)
+	dst = append(dst, encryptVersion, byte(len(k.activeID)))
+	dst = append(dst, k.activeID...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	plaintext := binary.AppendUvarint(nil, uint64(len(outputID)))
+	plaintext = append(plaintext, outputID...)
+	plaintext = binary.AppendUvarint(plaintext, uint64(len(body)))
+	plaintext = append(plaintext, body...)
+	return aead.Seal(dst, nonce, plaintext, blindID), nil
+}
+
+func (k *keyring) open(src, blindID []byte) (outputID, body []byte, err error) {
+	if !bytes.HasPrefix(src, encryptMagic) {
+		return nil, nil, errors.New("value is not encrypted")
+	}
+	src = src[len(encryptMagic):]
+	if len(src) < 2 || src[0] != encryptVersion {
+		return nil, nil, errors.New("unsupported encrypted value")
+	}
+	idLen := int(src[1])
+	src = src[2:]
+	if len(src) < idLen {
+		return nil, nil, errors.New("truncated encrypted value")
+	}
+	id := string(src[:idLen])
+	src = src[idLen:]
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown key %s", id)
+	}
+	if len(src) < aead.NonceSize() {
+		return nil, nil, errors.New("truncated encrypted value")
+	}
+	plaintext, err := aead.Open(nil, src[:aead.NonceSize()], src[aead.NonceSize():], blindID)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, l := binary.Uvarint(plaintext)
+	if l <= 0 || uint64(len(plaintext)-l) < n {
+		return nil, nil, errors.New("truncated encrypted value")
+	}
+	outputID, plaintext = plaintext[l:l+int(n)], plaintext[l+int(n):]
+	size, l := binary.Uvarint(plaintext)
+	if l <= 0 || uint64(len(plaintext)-l) != size {
+		return nil, nil, errors.New("truncated encrypted value")
+	}
+	return outputID, plaintext[l:], nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_EncryptStorage(t *testing.T) {
+	const (
+		oldKey = "old AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n"
+		newKey = "new AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=\n"
+	)
+	body := strings.Repeat("MinRana", 10)
+	put := func(t *testing.T, storage Storage) {
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("round trip hides body and OutputID", func(t *testing.T) {
+		external := newMemoryStorage()
+		storage := NewEncryptStorage(external, must(loadKeyring(strings.NewReader(oldKey))))
+		put(t, storage)
+		if bytes.Contains(external.bodies["ActionID_1"], []byte("MinRana")) {
+			t.Fatal("expected encrypted body")
+		}
+		if bytes.Equal(external.index["ActionID_1"].OutputID, []byte("OutputID_1")) {
+			t.Fatal("expected blinded OutputID")
+		}
+		get, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(get.OutputID) != "OutputID_1" || get.BodySize != int64(len(body)) {
+			t.Fatal("expected decrypted meta")
+		}
+		if string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected to be equal")
+		}
+		has, err := storage.Has(context.Background(), "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have", err)
+		}
+	})
+	t.Run("rotated key still decrypts", func(t *testing.T) {
+		external := newMemoryStorage()
+		put(t, NewEncryptStorage(external, must(loadKeyring(strings.NewReader(oldKey)))))
+		storage := NewEncryptStorage(external, must(loadKeyring(strings.NewReader(newKey+oldKey))))
+		get, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected to be equal")
+		}
+	})
+	t.Run("unknown key and plaintext are missed", func(t *testing.T) {
+		external := newMemoryStorage()
+		put(t, NewEncryptStorage(external, must(loadKeyring(strings.NewReader(oldKey)))))
+		_, ok, err := NewEncryptStorage(external, must(loadKeyring(strings.NewReader(newKey)))).Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("expected to be missing")
+		}
+		put(t, external)
+		_, ok, err = NewEncryptStorage(external, must(loadKeyring(strings.NewReader(oldKey)))).Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("expected to be missing")
+		}
+	})
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
@@ -12,42 +14,121 @@ import (
 	"path/filepath"
 )
 
+var (
+	fsDedupPuts       = expvar.NewInt("fs_dedup_puts")
+	fsDedupBytesSaved = expvar.NewInt("fs_dedup_bytes_saved")
+)
+
 type (
 	index struct {
 		OutputID []byte
 		Size     int64
+		Sum      []byte `json:",omitempty"`
 	}
+	// fileSystemStorage keeps small ActionID index files and OutputID-addressed body files,
+	// so actions producing the same output share one body on disk
 	fileSystemStorage struct {
-		dir string
+		dir    string
+		verify bool
+	}
+	// tempFileBody is a body already downloaded to a temporary file, Put moves the file instead of copying it
+	tempFileBody struct {
+		*os.File
 	}
 )
 
-func NewFileSystemStorage(dir string) Storage {
+// NewFileSystemStorage stores files in dir, verify enables checking body hash on every hit
+func NewFileSystemStorage(dir string, verify bool) Storage {
 	must0(os.MkdirAll(dir, 0755))
-	return &fileSystemStorage{dir: dir}
+	return &fileSystemStorage{dir: dir, verify: verify}
 }
 
 func (f fileSystemStorage) Get(_ context.Context, key string) (GetResponse, bool, error) {
-	diskPathBody, diskPathIndex := f.fileNames(key)
-	if isFileExists(diskPathBody) && isFileExists(diskPathIndex) {
-		var ind index
-		fileIndex, err := os.Open(diskPathIndex)
+	diskPathIndex := f.indexName(key)
+	if !isFileExists(diskPathIndex) {
+		return GetResponse{}, false, nil
+	}
+	var ind index
+	fileIndex, err := os.Open(diskPathIndex)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("error opening index file %s: %w", key, err)
+	}
+	defer fileIndex.Close()
+	err = json.NewDecoder(fileIndex).Decode(&ind)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("failed to unmarshal file %s: %w", key, err)
+	}
+	diskPathBody := f.bodyName(key, ind.OutputID)
+	if !isFileExists(diskPathBody) && !f.migrateLegacyBody(key, diskPathBody, ind.Size) {
+		return GetResponse{}, false, nil
+	}
+	if f.verify {
+		ok, err := f.verifyBody(diskPathBody, ind)
 		if err != nil {
-			return GetResponse{}, false, fmt.Errorf("error opening index file %s: %w", key, err)
+			return GetResponse{}, false, fmt.Errorf("failed to verify body %s: %w", key, err)
 		}
-		defer fileIndex.Close()
-		err = json.NewDecoder(fileIndex).Decode(&ind)
-		if err != nil {
-			return GetResponse{}, false, fmt.Errorf("failed to unmarshal file %s: %w", key, err)
+		if !ok {
+			f.quarantine(diskPathIndex, diskPathBody)
+			reportCorrupted("file system", key)
+			return GetResponse{}, false, nil
 		}
+	}
+	absDiskPathBody, err := filepath.Abs(diskPathBody)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("failed to determine absolute path for %s: %w", key, err)
+	}
+	return GetResponse{OutputID: ind.OutputID, DiskPath: absDiskPathBody, BodySize: ind.Size}, true, nil
+}
 
-		absDiskPathBody, err := filepath.Abs(diskPathBody)
-		if err != nil {
-			return GetResponse{}, false, fmt.Errorf("failed to determine absolute path for %s: %w", key, err)
-		}
-		return GetResponse{OutputID: ind.OutputID, DiskPath: absDiskPathBody, BodySize: ind.Size}, true, nil
+func (f fileSystemStorage) verifyBody(diskPathBody string, ind index) (bool, error) {
+	fileBody, err := os.Open(diskPathBody)
+	if err != nil {
+		return false, err
+	}
+	defer fileBody.Close()
+	return verifySum(fileBody, ind.Sum, ind.OutputID)
+}
+
+// quarantine moves files out of the cache, keeping them for inspection
+func (f fileSystemStorage) quarantine(paths ...string) {
+	dir := path.Join(f.dir, "quarantine")
+	os.MkdirAll(dir, 0755)
+	for _, p := range paths {
+		os.Rename(p, path.Join(dir, path.Base(p)))
+	}
+}
+
+// migrateLegacyBody moves a body stored per ActionID by older versions to its OutputID address,
+// hardlinking it so a body already stored for another action is reused, returns true if the body exists afterward
+func (f fileSystemStorage) migrateLegacyBody(key, diskPathBody string, size int64) bool {
+	diskPathLegacy := f.legacyBodyName(key)
+	if diskPathLegacy == diskPathBody || !isFileExists(diskPathLegacy) {
+		return false
+	}
+	err := os.Link(diskPathLegacy, diskPathBody)
+	if errors.Is(err, os.ErrExist) {
+		fsDedupBytesSaved.Add(size)
+	} else if err != nil {
+		return false
+	}
+	os.Remove(diskPathLegacy)
+	return isFileExists(diskPathBody)
+}
+
+func (f fileSystemStorage) Has(_ context.Context, key string, outputID []byte) (bool, error) {
+	indexBytes, err := os.ReadFile(f.indexName(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading index file %s: %w", key, err)
+	}
+	var ind index
+	err = json.Unmarshal(indexBytes, &ind)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal file %s: %w", key, err)
 	}
-	return GetResponse{}, false, nil
+	return bytes.Equal(ind.OutputID, outputID) && isFileExists(f.bodyName(key, outputID)), nil
 }
 
 func isFileExists(path string) bool {
@@ -58,33 +139,72 @@ func isFileExists(path string) bool {
 	return info.Mode().IsRegular()
 }
 
-func (f fileSystemStorage) fileNames(key string) (diskPathBody, diskPathIndex string) {
-	diskPathBody = path.Join(f.dir, key+"-o")
-	diskPathIndex = path.Join(f.dir, key+"-i")
-	return diskPathBody, diskPathIndex
+func (f fileSystemStorage) indexName(key string) string {
+	return path.Join(f.dir, key+"-i")
+}
+
+// bodyName addresses body by OutputID, falls back to the ActionID if OutputID is absent
+func (f fileSystemStorage) bodyName(key string, outputID []byte) string {
+	if len(outputID) == 0 {
+		return f.legacyBodyName(key)
+	}
+	return path.Join(f.dir, hex.EncodeToString(outputID)+"-d")
+}
+
+func (f fileSystemStorage) legacyBodyName(key string) string {
+	return path.Join(f.dir, key+"-o")
 }
 
 func (f fileSystemStorage) Put(_ context.Context, request PutRequest) (string, error) {
+	diskPath, _, err := f.put(request)
+	return diskPath, err
+}
+
+// put stores body and index files, returning the absolute body path and the stored index
+func (f fileSystemStorage) put(request PutRequest) (string, index, error) {
 	if len(request.Key) == 0 {
-		return "", errors.New("empty key")
+		return "", index{}, errors.New("empty key")
 	}
-	diskPathBody, diskPathIndex := f.fileNames(request.Key)
-	err := writeFileAtomically(diskPathBody, request.Body)
-	if err != nil {
-		return "", fmt.Errorf("error creating body file %s: %w", request.Key, err)
+	diskPathBody, diskPathIndex := f.bodyName(request.Key, request.OutputID), f.indexName(request.Key)
+	tmp, isTemp := request.Body.(tempFileBody)
+	if isTemp {
+		defer tmp.discard()
 	}
-	indexBytes, err := json.Marshal(index{
+	h := newContentHash()
+	body := io.TeeReader(request.Body, h)
+	if info, err := os.Stat(diskPathBody); err == nil && info.Mode().IsRegular() && info.Size() == request.BodySize {
+		fsDedupPuts.Add(1)
+		fsDedupBytesSaved.Add(request.BodySize)
+		_, err = io.Copy(io.Discard, body)
+		if err != nil {
+			return "", index{}, fmt.Errorf("error reading body %s: %w", request.Key, err)
+		}
+	} else if isTemp {
+		err := tmp.moveTo(diskPathBody, h)
+		if err != nil {
+			return "", index{}, fmt.Errorf("error moving body file %s: %w", request.Key, err)
+		}
+	} else {
+		err := writeFileAtomically(diskPathBody, body)
+		if err != nil {
+			return "", index{}, fmt.Errorf("error creating body file %s: %w", request.Key, err)
+		}
+	}
+	ind := index{
 		OutputID: request.OutputID,
 		Size:     request.BodySize,
-	})
+		Sum:      h.Sum(nil),
+	}
+	indexBytes, err := json.Marshal(ind)
 	if err != nil {
-		return "", fmt.Errorf("error marshalling index: %w %s", err, request.Key)
+		return "", index{}, fmt.Errorf("error marshalling index: %w %s", err, request.Key)
 	}
 	err = writeFileAtomically(diskPathIndex, bytes.NewReader(indexBytes))
 	if err != nil {
-		return "", fmt.Errorf("error creating index file %s: %w", request.Key, err)
+		return "", index{}, fmt.Errorf("error creating index file %s: %w", request.Key, err)
 	}
-	return filepath.Abs(diskPathBody)
+	absDiskPathBody, err := filepath.Abs(diskPathBody)
+	return absDiskPathBody, ind, err
 }
 
 func writeFileAtomically(path string, body io.Reader) error {
@@ -100,6 +220,45 @@ func writeFileAtomically(path string, body io.Reader) error {
 	return os.Rename(file.Name(), path)
 }
 
+// moveTo hashes the file and renames it to path, copying it if rename fails, e.g. across devices
+func (t tempFileBody) moveTo(path string, h io.Writer) error {
+	_, err := io.Copy(h, t.File)
+	if err != nil {
+		return err
+	}
+	if os.Rename(t.Name(), path) == nil {
+		return nil
+	}
+	_, err = t.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, t.File)
+}
+
+// discard closes and removes the file unless it was moved
+func (t tempFileBody) discard() {
+	t.Close()
+	os.Remove(t.Name())
+}
+
+// discardBody releases a body of a hit that is not handed over to Put,
+// removing its temporary file or closing its stream
+func discardBody(body io.Reader) {
+	switch b := body.(type) {
+	case tempFileBody:
+		b.discard()
+	case io.Closer:
+		b.Close()
+	}
+}
+
+// readBody reads body of a hit into memory and releases it
+func readBody(body io.Reader) ([]byte, error) {
+	defer discardBody(body)
+	return io.ReadAll(body)
+}
+
 func (f fileSystemStorage) Close(context.Context) error {
 	return nil
 }
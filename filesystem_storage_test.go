@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_FileSystemStorage(t *testing.T) {
+	t.Run("actions with the same output share body", func(t *testing.T) {
+		storage := NewFileSystemStorage(t.TempDir(), false)
+		body := must(randomString(100))
+		diskPath1, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved := fsDedupBytesSaved.Value()
+		diskPath2, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_2", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: 100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diskPath1 != diskPath2 {
+			t.Fatalf("expected shared body, got %s and %s", diskPath1, diskPath2)
+		}
+		if fsDedupBytesSaved.Value()-saved < 100 {
+			t.Fatal("expected saved bytes to be counted")
+		}
+		get, ok, err := storage.Get(context.Background(), "ActionID_2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || get.DiskPath != diskPath1 {
+			t.Fatal("expected to be found at shared body")
+		}
+	})
+	t.Run("legacy body is migrated on get", func(t *testing.T) {
+		dir := t.TempDir()
+		must0(os.WriteFile(path.Join(dir, "ActionID_1-i"), []byte(`{"OutputID":"T3V0cHV0SURfMQ==","Size":5}`), 0644))
+		must0(os.WriteFile(path.Join(dir, "ActionID_1-o"), []byte("hello"), 0644))
+		storage := NewFileSystemStorage(dir, false)
+		get, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(must(os.ReadFile(get.DiskPath))) != "hello" {
+			t.Fatal("expected migrated body")
+		}
+		if isFileExists(path.Join(dir, "ActionID_1-o")) {
+			t.Fatal("expected legacy body to be removed")
+		}
+	})
+	t.Run("corrupted body is quarantined and missed", func(t *testing.T) {
+		storage := NewFileSystemStorage(t.TempDir(), true)
+		diskPath, err := storage.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := storage.Get(context.Background(), "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		must0(os.WriteFile(diskPath, []byte("hell"), 0644))
+		failures := integrityFailures.Value()
+		_, ok, err = storage.Get(context.Background(), "ActionID_1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Fatal("expected to be missing")
+		}
+		if integrityFailures.Value()-failures < 1 {
+			t.Fatal("expected failure to be counted")
+		}
+		if isFileExists(diskPath) {
+			t.Fatal("expected body to be quarantined")
+		}
+	})
+}
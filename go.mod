@@ -1,14 +1,27 @@
 module git.sbercloud.tech/cp/go/utils/gocacheprog
 
-go 1.24
+go 1.24.0
 
 require (
+	github.com/alicebob/miniredis/v2 v2.35.0
+	github.com/bazelbuild/remote-apis v0.0.0-20260331222004-becdd8f9ff81
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f
+	github.com/klauspost/compress v1.19.0
 	github.com/redis/go-redis/v9 v9.10.0
+	go.etcd.io/bbolt v1.4.3
 	go.uber.org/mock v0.5.2
+	google.golang.org/genproto/googleapis/bytestream v0.0.0-20250603155806-513f23925822
+	google.golang.org/grpc v1.76.0
+	google.golang.org/protobuf v1.36.11
 )
 
 require (
-	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/klauspost/compress v1.19.0 // indirect
+	cloud.google.com/go/longrunning v0.8.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	golang.org/x/net v0.47.0 // indirect
+	golang.org/x/sys v0.38.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
+	google.golang.org/genproto/googleapis/api v0.0.0-20260203192932-546029d2fa20 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260203192932-546029d2fa20 // indirect
 )
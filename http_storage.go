@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const httpRetryDelay = 200 * time.Millisecond
+
+var (
+	httpUploadSkips      = expvar.NewInt("http_upload_skips")
+	httpUploadBytesSaved = expvar.NewInt("http_upload_bytes_saved")
+	httpRetries          = expvar.NewInt("http_retries")
+)
+
+type (
+	// httpStorage talks to bazel-remote style servers: ActionID is mapped to a JSON meta record in /ac/
+	// and body to a blob in /cas/ addressed by its sha256, so a body is uploaded once for all actions producing it
+	httpStorage struct {
+		*httpEndpoint
+		verify bool
+	}
+	// httpEndpoint sends authorized requests relative to base url, retrying network errors and server failures
+	httpEndpoint struct {
+		client  *http.Client
+		base    *url.URL
+		user    string
+		pwd     string
+		token   string
+		retries int
+	}
+	HTTPOptions struct {
+		//URL of the cache server, may have a path prefix and basic auth credentials
+		URL      string
+		User     string
+		Password string
+		//Token is sent as bearer token instead of basic auth, if set
+		Token string
+		//Retries of requests failed by network or server errors
+		Retries int
+		//Verify enables checking body hash on download
+		Verify bool
+	}
+)
+
+func NewHTTPStorage(client *http.Client, options HTTPOptions) (Storage, error) {
+	endpoint, err := newHTTPEndpoint(client, options)
+	if err != nil {
+		return nil, err
+	}
+	return &httpStorage{httpEndpoint: endpoint, verify: options.Verify}, nil
+}
+
+// newHTTPEndpoint takes URL, credentials and retries of options
+func newHTTPEndpoint(client *http.Client, options HTTPOptions) (*httpEndpoint, error) {
+	base, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid http cache url: %w", err)
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, fmt.Errorf("invalid http cache url: %s", options.URL)
+	}
+	return &httpEndpoint{
+		client:  client,
+		base:    base,
+		user:    options.User,
+		pwd:     options.Password,
+		token:   options.Token,
+		retries: options.Retries,
+	}, nil
+}
+
+// newHTTPClient returns client keeping enough idle connections for concurrent requests of the go command
+func newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = 256
+	transport.MaxIdleConnsPerHost = 64
+	return &http.Client{Transport: transport}
+}
+
+// ping checks that the server is reachable with the credentials by looking up an absent record
+func (h *httpStorage) ping(ctx context.Context) error {
+	_, _, err := h.getMeta(ctx, strings.Repeat("0", sha256.Size*2))
+	return err
+}
+
+func (h *httpStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return GetResponse{}, false, fmt.Errorf("empty key")
+	}
+	m, ok, err := h.getMeta(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, false, err
+	}
+	sum := expectedSum(m.Sum, m.OutputID)
+	if sum == nil {
+		//cas is addressed by hash
+		return GetResponse{}, false, nil
+	}
+	resp, err := h.do(ctx, http.MethodGet, casPath(sum), nil, nil, 0)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("http cas get error: %w %s", err, key)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		resp.Body.Close()
+		return GetResponse{}, false, fmt.Errorf("http cas get error: %s %s", resp.Status, key)
+	}
+	if resp.StatusCode == http.StatusNotFound || resp.ContentLength >= 0 && resp.ContentLength != m.Size {
+		//blob was evicted or does not match the record
+		resp.Body.Close()
+		return GetResponse{}, false, nil
+	}
+	body := &streamBody{storage: "http", key: key, body: resp.Body}
+	if h.verify {
+		body.hash, body.expected = newContentHash(), sum
+	}
+	return GetResponse{OutputID: m.OutputID, BodySize: m.Size, Body: body}, true, nil
+}
+
+// getMeta returns action cache record of key, false if it is absent
+func (h *httpStorage) getMeta(ctx context.Context, key string) (meta, bool, error) {
+	resp, err := h.do(ctx, http.MethodGet, acPath(key), nil, nil, 0)
+	if err != nil {
+		return meta{}, false, fmt.Errorf("http ac get error: %w %s", err, key)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return meta{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return meta{}, false, fmt.Errorf("http ac get error: %s %s", resp.Status, key)
+	}
+	var m meta
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		return meta{}, false, fmt.Errorf("http ac Unmarshal error: %w %s", err, key)
+	}
+	return m, true, nil
+}
+
+func (h *httpStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	//body is read twice: to address it by hash and to upload it
+	body, ok := request.Body.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(request.Body)
+		if err != nil {
+			return "", fmt.Errorf("http bodyReadAll error: %w %s", err, request.Key)
+		}
+		body = bytes.NewReader(b)
+	}
+	hasher := newContentHash()
+	size, err := io.Copy(hasher, body)
+	if err != nil {
+		return "", fmt.Errorf("http body hash error: %w %s", err, request.Key)
+	}
+	sum := hasher.Sum(nil)
+	exists, err := h.hasBlob(ctx, sum)
+	if err != nil {
+		return "", fmt.Errorf("http cas head error: %w %s", err, request.Key)
+	}
+	if exists {
+		httpUploadSkips.Add(1)
+		httpUploadBytesSaved.Add(size)
+	} else {
+		err = h.put(ctx, casPath(sum), body, size)
+		if err != nil {
+			return "", fmt.Errorf("http cas put error: %w %s", err, request.Key)
+		}
+	}
+	metaBytes, err := json.Marshal(meta{OutputID: request.OutputID, Size: size, Sum: sum})
+	if err != nil {
+		return "", fmt.Errorf("http metaMarshal error: %w %s", err, request.Key)
+	}
+	err = h.put(ctx, acPath(request.Key), bytes.NewReader(metaBytes), int64(len(metaBytes)))
+	if err != nil {
+		return "", fmt.Errorf("http ac put error: %w %s", err, request.Key)
+	}
+	//no disk path to return
+	return "", nil
+}
+
+func (h *httpStorage) put(ctx context.Context, p string, body io.ReadSeeker, size int64) error {
+	resp, err := h.do(ctx, http.MethodPut, p, nil, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+func (h *httpStorage) hasBlob(ctx context.Context, sum []byte) (bool, error) {
+	resp, err := h.do(ctx, http.MethodHead, casPath(sum), nil, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.New(resp.Status)
+	}
+	return true, nil
+}
+
+func (h *httpStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	m, ok, err := h.getMeta(ctx, key)
+	if err != nil || !ok || !bytes.Equal(m.OutputID, outputID) || len(m.Sum) == 0 {
+		return false, err
+	}
+	ok, err = h.hasBlob(ctx, m.Sum)
+	if err != nil {
+		return false, fmt.Errorf("http cas head error: %w %s", err, key)
+	}
+	return ok, nil
+}
+
+func (h *httpEndpoint) Close(_ context.Context) error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// do sends request to path relative to the base url, body is rewound before every attempt
+func (h *httpEndpoint) do(ctx context.Context, method, p string, header http.Header, body io.ReadSeeker, size int64) (*http.Response, error) {
+	u := *h.base
+	u.Path = path.Join("/", u.Path, p)
+	u.RawPath = ""
+	var lastErr error
+	for attempt := 0; attempt <= h.retries; attempt++ {
+		if attempt > 0 {
+			httpRetries.Add(1)
+			select {
+			case <-time.After(httpRetryDelay << (attempt - 1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			_, err = body.Seek(0, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+			req.Body, req.ContentLength = io.NopCloser(body), size
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		if h.token != "" {
+			req.Header.Set("Authorization", "Bearer "+h.token)
+		} else if h.user != "" {
+			req.SetBasicAuth(h.user, h.pwd)
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < http.StatusInternalServerError && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		//drained body lets the connection be reused
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		lastErr = errors.New(resp.Status)
+	}
+	return nil, lastErr
+}
+
+// acPath addresses action cache record
+func acPath(key string) string {
+	return "ac/" + actionHash(key)
+}
+
+// actionHash returns ActionID as hex sha256, other keys such as dictionary ones are hashed,
+// as servers validate action cache keys
+func actionHash(key string) string {
+	if b, err := hex.DecodeString(key); err != nil || len(b) != sha256.Size {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	return strings.ToLower(key)
+}
+
+func casPath(sum []byte) string {
+	return "cas/" + hex.EncodeToString(sum)
+}
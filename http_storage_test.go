@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_HTTPStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Run("round trip with bearer token", func(t *testing.T) {
+		server := newFakeBazelRemote(t, "Bearer secret")
+		storage := must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL + "/cache", Token: "secret"}))
+		key := hex.EncodeToString(contentHash([]byte("ActionID_1")))
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := server.blobs["/cache/cas/"+hex.EncodeToString(contentHash([]byte("hello")))]; !ok {
+			t.Fatal("expected body to be stored in cas")
+		}
+		if _, ok := server.blobs["/cache/ac/"+key]; !ok {
+			t.Fatal("expected record to be stored in ac under ActionID")
+		}
+		get, ok, err := storage.Get(ctx, key)
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if string(get.OutputID) != "OutputID_1" || string(must(io.ReadAll(get.Body))) != "hello" {
+			t.Fatal("expected stored entry")
+		}
+		has, err := storage.Has(ctx, key, []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		_, ok, err = storage.Get(ctx, hex.EncodeToString(contentHash([]byte("ActionID_2"))))
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("basic auth is required", func(t *testing.T) {
+		server := newFakeBazelRemote(t, "Basic dXNyOnB3ZA==")
+		storage := must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL, User: "usr", Password: "pwd"}))
+		if err := storage.(*httpStorage).ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		storage = must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL}))
+		if err := storage.(*httpStorage).ping(ctx); err == nil {
+			t.Fatal("expected unauthorized")
+		}
+	})
+	t.Run("body shared by actions is uploaded once", func(t *testing.T) {
+		server := newFakeBazelRemote(t, "")
+		storage := must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL}))
+		for _, key := range []string{"ActionID_1", "ActionID_2"} {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if server.casPuts.Load() != 1 {
+			t.Fatalf("expected one cas upload, got %d", server.casPuts.Load())
+		}
+	})
+	t.Run("server failures are retried", func(t *testing.T) {
+		server := newFakeBazelRemote(t, "")
+		server.failures.Store(2)
+		storage := must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL, Retries: 2}))
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.failures.Store(3)
+		_, _, err = storage.Get(ctx, "ActionID_1")
+		if err == nil {
+			t.Fatal("expected error after retries are exhausted")
+		}
+	})
+	t.Run("corrupted body is a miss", func(t *testing.T) {
+		server := newFakeBazelRemote(t, "")
+		remote := must(NewHTTPStorage(server.Client(), HTTPOptions{URL: server.URL, Verify: true}))
+		_, err := remote.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.blobs["/cas/"+hex.EncodeToString(contentHash([]byte("hello")))] = []byte("jello")
+		storage := NewDecoratorStorage(NewFileSystemStorage(t.TempDir(), false), remote)
+		_, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+}
+
+type fakeBazelRemote struct {
+	*httptest.Server
+	mu       sync.Mutex
+	blobs    map[string][]byte
+	casPuts  atomic.Int64
+	failures atomic.Int64
+}
+
+// newFakeBazelRemote serves /ac/ and /cas/ of bazel-remote, requiring authorization header if it is set
+func newFakeBazelRemote(t *testing.T, authorization string) *fakeBazelRemote {
+	f := &fakeBazelRemote{blobs: map[string][]byte{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Authorization") != authorization {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			if strings.Contains(r.URL.Path, "/cas/") {
+				f.casPuts.Add(1)
+			}
+			f.blobs[r.URL.Path] = must(io.ReadAll(r.Body))
+		case http.MethodGet, http.MethodHead:
+			b, ok := f.blobs[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(b)
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	indexFileName = "index.db"
+	//indexLockTimeout is how long to wait for another process holding the index
+	indexLockTimeout = time.Second
+	//atimeResolution limits index writes on hits, as relatime does for files
+	atimeResolution = time.Hour
+)
+
+var indexBucket = []byte("entries")
+
+type (
+	// indexedStorage is a file system storage keeping its entries in an embedded B-tree file,
+	// so a hit is a single lookup instead of reading an index file, body files stay on disk for DiskPath
+	indexedStorage struct {
+		fileSystemStorage
+		db   *bolt.DB
+		once sync.Once
+	}
+	indexEntry struct {
+		OutputID []byte
+		Size     int64
+		Sum      []byte `json:",omitempty"`
+		Atime    time.Time
+		//Body is the name of the body file in dir
+		Body string
+	}
+)
+
+// NewIndexedFileSystemStorage stores files in dir with the index in dir/index.db,
+// it fails if another process holds the index
+func NewIndexedFileSystemStorage(dir string, verify bool) (Storage, error) {
+	must0(os.MkdirAll(dir, 0755))
+	db, err := bolt.Open(path.Join(dir, indexFileName), 0644, &bolt.Options{Timeout: indexLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("error opening index: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(indexBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating index: %w", err)
+	}
+	return &indexedStorage{fileSystemStorage: fileSystemStorage{dir: dir, verify: verify}, db: db}, nil
+}
+
+func (s *indexedStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	entry, ok, err := s.lookup(key)
+	if err != nil {
+		return GetResponse{}, false, err
+	}
+	if !ok {
+		return s.backfill(ctx, key)
+	}
+	diskPathBody := path.Join(s.dir, entry.Body)
+	//bodies may be removed behind the index, e.g. by hand, so the entry goes with them
+	if !isFileExists(diskPathBody) {
+		s.remove(key)
+		return GetResponse{}, false, nil
+	}
+	if s.verify {
+		ok, err := s.verifyBody(diskPathBody, index{OutputID: entry.OutputID, Size: entry.Size, Sum: entry.Sum})
+		if err != nil {
+			return GetResponse{}, false, fmt.Errorf("failed to verify body %s: %w", key, err)
+		}
+		if !ok {
+			s.remove(key)
+			s.quarantine(s.indexName(key), diskPathBody)
+			reportCorrupted("file system", key)
+			return GetResponse{}, false, nil
+		}
+	}
+	if now := time.Now(); now.Sub(entry.Atime) > atimeResolution {
+		entry.Atime = now
+		s.store(key, entry)
+	}
+	absDiskPathBody, err := filepath.Abs(diskPathBody)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("failed to determine absolute path for %s: %w", key, err)
+	}
+	return GetResponse{OutputID: entry.OutputID, DiskPath: absDiskPathBody, BodySize: entry.Size}, true, nil
+}
+
+// backfill looks up index files stored before the index was enabled, adding entries found to the index
+func (s *indexedStorage) backfill(ctx context.Context, key string) (GetResponse, bool, error) {
+	resp, ok, err := s.fileSystemStorage.Get(ctx, key)
+	if err != nil || !ok {
+		return resp, ok, err
+	}
+	//without the sum verification falls back to OutputID
+	err = s.store(key, indexEntry{OutputID: resp.OutputID, Size: resp.BodySize, Atime: time.Now(), Body: path.Base(resp.DiskPath)})
+	if err != nil {
+		return GetResponse{}, false, err
+	}
+	return resp, true, nil
+}
+
+// backfillDir adds entries of index files written without the index, by older versions or by processes
+// which could not open it, and returns names of body files in dir, so sweeps count and evict all of them
+func (s *indexedStorage) backfillDir() ([]string, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var bodies, keys []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		switch {
+		case strings.HasSuffix(name, "-d") || strings.HasSuffix(name, "-o"):
+			bodies = append(bodies, name)
+		case strings.HasSuffix(name, "-i"):
+			keys = append(keys, strings.TrimSuffix(name, "-i"))
+		}
+	}
+	var unindexed []string
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket)
+		for _, key := range keys {
+			if b.Get([]byte(key)) == nil {
+				unindexed = append(unindexed, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading index: %w", err)
+	}
+	for _, key := range unindexed {
+		entry, ok := s.readIndexFile(key)
+		if !ok {
+			continue
+		}
+		err = s.store(key, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bodies, nil
+}
+
+// readIndexFile returns entry of index file of key with its modification time as access time,
+// false if it is unreadable or its body is missing
+func (s *indexedStorage) readIndexFile(key string) (indexEntry, bool) {
+	info, err := os.Stat(s.indexName(key))
+	if err != nil {
+		return indexEntry{}, false
+	}
+	b, err := os.ReadFile(s.indexName(key))
+	if err != nil {
+		return indexEntry{}, false
+	}
+	var ind index
+	if json.Unmarshal(b, &ind) != nil {
+		return indexEntry{}, false
+	}
+	diskPathBody := s.bodyName(key, ind.OutputID)
+	if !isFileExists(diskPathBody) {
+		return indexEntry{}, false
+	}
+	return indexEntry{OutputID: ind.OutputID, Size: ind.Size, Sum: ind.Sum, Atime: info.ModTime(), Body: path.Base(diskPathBody)}, true
+}
+
+// Put writes index files as well, so the dir stays usable without the index
+func (s *indexedStorage) Put(_ context.Context, request PutRequest) (string, error) {
+	diskPath, ind, err := s.put(request)
+	if err != nil {
+		return "", err
+	}
+	err = s.store(request.Key, indexEntry{
+		OutputID: ind.OutputID,
+		Size:     ind.Size,
+		Sum:      ind.Sum,
+		Atime:    time.Now(),
+		Body:     path.Base(diskPath),
+	})
+	if err != nil {
+		return "", err
+	}
+	return diskPath, nil
+}
+
+func (s *indexedStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	entry, ok, err := s.lookup(key)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return s.fileSystemStorage.Has(ctx, key, outputID)
+	}
+	return bytes.Equal(entry.OutputID, outputID) && isFileExists(path.Join(s.dir, entry.Body)), nil
+}
+
+func (s *indexedStorage) Close(context.Context) error {
+	var err error
+	s.once.Do(func() {
+		err = s.db.Close()
+	})
+	return err
+}
+
+func (s *indexedStorage) lookup(key string) (indexEntry, bool, error) {
+	var entry indexEntry
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket).Get([]byte(key))
+		if b == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(b, &entry)
+	})
+	if err != nil {
+		return indexEntry{}, false, fmt.Errorf("error reading index %s: %w", key, err)
+	}
+	return entry, ok, nil
+}
+
+// store writes entry, concurrent writes are committed together
+func (s *indexedStorage) store(key string, entry indexEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling index: %w %s", err, key)
+	}
+	err = s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).Put([]byte(key), b)
+	})
+	if err != nil {
+		return fmt.Errorf("error writing index %s: %w", key, err)
+	}
+	return nil
+}
+
+// remove deletes entries of keys with their index files, leaving bodies which may be shared
+func (s *indexedStorage) remove(keys ...string) error {
+	err := s.db.Batch(func(tx *bolt.Tx) error {
+		for _, key := range keys {
+			err := tx.Bucket(indexBucket).Delete([]byte(key))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error removing from index: %w", err)
+	}
+	for _, key := range keys {
+		err := os.Remove(s.indexName(key))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// each calls fn for every entry in key order, without reading the dir
+func (s *indexedStorage) each(fn func(key string, entry indexEntry)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucket).ForEach(func(k, v []byte) error {
+			var entry indexEntry
+			err := json.Unmarshal(v, &entry)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal index entry %s: %w", k, err)
+			}
+			fn(string(k), entry)
+			return nil
+		})
+	})
+}
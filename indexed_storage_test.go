@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_IndexedStorage(t *testing.T) {
+	ctx := context.Background()
+	put := func(t *testing.T, storage Storage, key string) string {
+		diskPath, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diskPath
+	}
+	t.Run("hit is served by index", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := must(NewIndexedFileSystemStorage(dir, true))
+		defer storage.Close(ctx)
+		diskPath := put(t, storage, "ActionID_1")
+		//index file is kept for runs without the index
+		must0(os.Remove(path.Join(dir, "ActionID_1-i")))
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if get.DiskPath != diskPath || get.BodySize != 5 || string(get.OutputID) != "OutputID_1" {
+			t.Fatal("expected stored entry", get)
+		}
+		if has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1")); err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		if has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_2")); err != nil || has {
+			t.Fatal("expected other output to be missing", err)
+		}
+	})
+	t.Run("entries stored without index are added on get", func(t *testing.T) {
+		dir := t.TempDir()
+		put(t, NewFileSystemStorage(dir, false), "ActionID_1")
+		storage := must(NewIndexedFileSystemStorage(dir, false)).(*indexedStorage)
+		defer storage.Close(ctx)
+		if _, ok, err := storage.Get(ctx, "ActionID_1"); err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if _, ok, err := storage.lookup("ActionID_1"); err != nil || !ok {
+			t.Fatal("expected entry to be added to index", err)
+		}
+	})
+	t.Run("entry of removed body is a miss", func(t *testing.T) {
+		storage := must(NewIndexedFileSystemStorage(t.TempDir(), false)).(*indexedStorage)
+		defer storage.Close(ctx)
+		must0(os.Remove(put(t, storage, "ActionID_1")))
+		if _, ok, err := storage.Get(ctx, "ActionID_1"); err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+		if _, ok, _ := storage.lookup("ActionID_1"); ok {
+			t.Fatal("expected entry to be removed")
+		}
+	})
+	t.Run("corrupted body is quarantined", func(t *testing.T) {
+		storage := must(NewIndexedFileSystemStorage(t.TempDir(), true))
+		defer storage.Close(ctx)
+		must0(os.WriteFile(put(t, storage, "ActionID_1"), []byte("jello"), 0644))
+		if _, ok, err := storage.Get(ctx, "ActionID_1"); err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("access time is refreshed on stale hits", func(t *testing.T) {
+		storage := must(NewIndexedFileSystemStorage(t.TempDir(), false)).(*indexedStorage)
+		defer storage.Close(ctx)
+		put(t, storage, "ActionID_1")
+		entry, _, _ := storage.lookup("ActionID_1")
+		entry.Atime = time.Now().Add(-2 * atimeResolution)
+		must0(storage.store("ActionID_1", entry))
+		storage.Get(ctx, "ActionID_1")
+		if entry, _, _ := storage.lookup("ActionID_1"); time.Since(entry.Atime) > time.Minute {
+			t.Fatal("expected access time to be refreshed")
+		}
+	})
+	t.Run("index held by another storage is not opened", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := must(NewIndexedFileSystemStorage(dir, false))
+		defer storage.Close(ctx)
+		if _, err := NewIndexedFileSystemStorage(dir, false); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func Test_EvictingIndexedStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	indexed := must(NewIndexedFileSystemStorage(dir, false)).(*indexedStorage)
+	defer indexed.Close(ctx)
+	storage := &evictingStorage{Storage: indexed, dir: dir, sweeps: make(chan struct{}, 1)}
+	body := strings.Repeat("a", 400)
+	//ActionID_4 shares the body of ActionID_1 and keeps it in use
+	for i, key := range []string{"ActionID_1", "ActionID_2", "ActionID_3", "ActionID_4"} {
+		outputID := []byte("OutputID_" + key)
+		if key == "ActionID_4" {
+			outputID = []byte("OutputID_ActionID_1")
+		}
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader(body), BodySize: 400})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, _, _ := indexed.lookup(key)
+		entry.Atime = time.Now().Add(time.Duration(i-4) * time.Hour)
+		must0(indexed.store(key, entry))
+	}
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := storage.dirStats(); stats.Size != 1200 || stats.Entries != 4 || stats.Bodies != 3 {
+		t.Fatalf("expected 4 entries sharing 3 bodies of 1200 bytes, got %+v", stats)
+	}
+	storage.maxSize = 1199
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{"ActionID_1": true, "ActionID_2": false, "ActionID_3": true, "ActionID_4": true} {
+		_, ok, err := storage.Get(ctx, key)
+		if err != nil || ok != expected {
+			t.Fatalf("expected %s to be found: %v, %v", key, expected, err)
+		}
+	}
+	if isFileExists(path.Join(dir, "ActionID_2-i")) {
+		t.Fatal("expected index file to be evicted")
+	}
+	if stats := storage.dirStats(); stats.Size != 800 || stats.Entries != 3 || stats.Bodies != 2 {
+		t.Fatalf("expected 3 entries sharing 2 bodies, got %+v", stats)
+	}
+}
+
+func Test_EvictingIndexedStorageBackfill(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	indexed := must(NewIndexedFileSystemStorage(dir, false)).(*indexedStorage)
+	defer indexed.Close(ctx)
+	storage := &evictingStorage{Storage: indexed, dir: dir, sweeps: make(chan struct{}, 1)}
+	body := strings.Repeat("a", 400)
+	put := func(s Storage, key string) {
+		_, err := s.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_" + key), Body: strings.NewReader(body), BodySize: 400})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(storage, "ActionID_1")
+	//written by a process which fell back to index files, and a body whose index file is gone
+	fs := fileSystemStorage{dir: dir}
+	old := time.Now().Add(-time.Hour)
+	for _, key := range []string{"ActionID_2", "ActionID_3"} {
+		put(fs, key)
+		os.Chtimes(fs.indexName(key), old, old)
+		os.Chtimes(fs.bodyName(key, []byte("OutputID_"+key)), old, old)
+	}
+	must0(os.Remove(fs.indexName("ActionID_3")))
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := storage.dirStats(); stats.Size != 1200 || stats.Entries != 2 || stats.Bodies != 3 {
+		t.Fatalf("expected 2 entries and 3 bodies of 1200 bytes, got %+v", stats)
+	}
+	if entry, ok, err := indexed.lookup("ActionID_2"); err != nil || !ok || !entry.Atime.Equal(old) {
+		t.Fatal("expected entry to be added with time of its index file", entry, err)
+	}
+	storage.maxSize = 500
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := storage.dirStats(); stats.Size != 400 || stats.Entries != 1 || stats.Bodies != 1 {
+		t.Fatalf("expected only the indexed entry to be left, got %+v", stats)
+	}
+	if _, ok, err := storage.Get(ctx, "ActionID_1"); err != nil || !ok {
+		t.Fatal("expected to be found", err)
+	}
+}
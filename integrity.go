@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+const (
+	verifyOff    = "off"
+	verifyRemote = "remote"
+	verifyAll    = "all"
+)
+
+var (
+	integrityFailures = expvar.NewInt("integrity_failures")
+	errCorruptedBody  = errors.New("corrupted body")
+)
+
+// streamBody streams downloaded body, closing it at the end and checking its hash if expected is set,
+// a mismatch fails the last read with errCorruptedBody
+type streamBody struct {
+	storage  string
+	key      string
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func newContentHash() hash.Hash {
+	return sha256.New()
+}
+
+// expectedSum returns content hash body must have: the stored one,
+// or OutputID of entries stored without it, as the go command uses content hash as OutputID
+func expectedSum(sum, outputID []byte) []byte {
+	if len(sum) != 0 {
+		return sum
+	}
+	if len(outputID) == sha256.Size {
+		return outputID
+	}
+	return nil
+}
+
+// verifySum reports whether body matches expected content hash, unverifiable bodies are considered valid
+func verifySum(body io.Reader, sum, outputID []byte) (bool, error) {
+	expected := expectedSum(sum, outputID)
+	if expected == nil {
+		return true, nil
+	}
+	h := newContentHash()
+	_, err := io.Copy(h, body)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(h.Sum(nil), expected), nil
+}
+
+func reportCorrupted(storage, key string) {
+	integrityFailures.Add(1)
+	fmt.Fprintf(os.Stderr, "%s: corrupted entry %s is quarantined\n", storage, key)
+}
+
+func contentHash(body []byte) []byte {
+	h := newContentHash()
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func (b *streamBody) Close() error {
+	return b.body.Close()
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if b.hash != nil {
+		b.hash.Write(p[:n])
+	}
+	if err == nil {
+		return n, nil
+	}
+	b.body.Close()
+	if errors.Is(err, io.EOF) && b.hash != nil && !bytes.Equal(b.hash.Sum(nil), b.expected) {
+		reportCorrupted(b.storage, b.key)
+		return n, errCorruptedBody
+	}
+	return n, err
+}
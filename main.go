@@ -2,14 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"runtime/trace"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -19,12 +24,69 @@ var (
 	logRequest     = flag.Bool("log-req", false, "log requests")
 	logMetrics     = flag.Bool("log-metrics", false, "log metrics")
 	dir            = flag.String("dir", "", "local dir of cache")
-	compress       = flag.Bool("compress", false, "compress cache files")
+	dirIndex       = flag.Bool("index", false, "keep entries of -dir in an embedded index file, hits are a single lookup instead of reading index files")
+	compress       = flag.Bool("compress", false, "compress files stored in redis")
+	compressCodec  = flag.String("compress-codec", "zstd", "compression codec: zstd, s2, snappy, gzip or none")
+	compressLevel  = flag.Int("compress-level", 0, "compression level of codec, 0 means codec default")
+	compressRatio  = flag.Float64("compress-min-ratio", 1.1, "store raw artifacts with estimated compression ratio below, 0 compresses everything")
+	encryptKeys    = flag.String("encrypt-keys", "", "file with keys to encrypt redis entries, or set them in "+encryptKeysEnv)
+	signKey        = flag.String("sign-key", "", "file with ed25519 key to sign redis entries")
+	trustedKeys    = flag.String("trusted-keys", "", "file with ed25519 public keys whose redis entries are accepted, without -sign-key redis is only read")
+	policyFile     = flag.String("policy", "", "file with policy deciding which builds may write to redis")
+	verify         = flag.String("verify", verifyOff, "verify artifacts integrity: off, remote (on download) or all (also on local hits)")
 	traceProfile   = flag.String("traceprofile", "", "write trace profile to file")
 	redisUser      = flag.String("r-usr", "", "redis user")
 	redisPassword  = flag.String("r-pwd", "", "redis password")
 	redisAddresses = flag.String("r-urls", "", "comma separated redis addresses")
 	redisKeyPrefix = flag.String("r-prefix", "", "string to prefix redis cache keys")
+	redisReads     = flag.String("r-read-prefixes", "", "comma separated prefixes looked up in order instead of -r-prefix, e.g. branch/foo,main")
+	redisPromote   = flag.Bool("r-promote", false, "copy entries found by -r-read-prefixes into -r-prefix")
+	toolchainNS    = flag.Bool("toolchain-ns", false, "separate redis keys of every go version, GOOS and GOARCH")
+	retireDays     = flag.Int("retire-days", 0, "namespaces: delete redis keyspaces not used for this many days")
+	redisMode      = flag.String("r-mode", redisModeReadWrite, "redis mode: rw, ro (only read) or quarantine (write to -r-quarantine-prefix)")
+	redisQPrefix   = flag.String("r-quarantine-prefix", "quarantine", "prefix appended to -r-prefix for writes in quarantine mode")
+	s3Endpoint     = flag.String("s3-endpoint", "", "URL of S3-compatible object store used instead of redis, e.g. https://s3.amazonaws.com, credentials are taken from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	s3Bucket       = flag.String("s3-bucket", "", "bucket of -s3-endpoint")
+	s3Prefix       = flag.String("s3-prefix", "", "string to prefix object keys")
+	s3Region       = flag.String("s3-region", "us-east-1", "region of -s3-endpoint")
+	httpURL        = flag.String("http-url", "", "URL of bazel-remote style HTTP cache used instead of redis, e.g. https://cache.example.com")
+	httpUser       = flag.String("http-usr", "", "HTTP cache basic auth user")
+	httpPassword   = flag.String("http-pwd", "", "HTTP cache basic auth password")
+	httpToken      = flag.String("http-token", "", "HTTP cache bearer token, or set it in "+httpTokenEnv)
+	httpRetryCount = flag.Int("http-retries", 2, "retries of HTTP cache requests failed by network or server errors")
+	reapiURL       = flag.String("reapi-url", "", "Remote Execution API cache used instead of redis, grpc://host:port or grpcs://host:port for TLS")
+	reapiInstance  = flag.String("reapi-instance", "", "instance name of -reapi-url")
+	reapiToken     = flag.String("reapi-token", "", "bearer token of -reapi-url, which must be grpcs://, or set it in "+reapiTokenEnv)
+	mcServers      = flag.String("mc-servers", "", "comma separated memcached addresses used instead of redis")
+	mcPrefix       = flag.String("mc-prefix", "", "string to prefix memcached keys")
+	mcItemSize     = flag.Int("mc-item-size", memcachedItemSize, "item size limit of memcached servers, larger bodies are chunked")
+	serverURL      = flag.String("server-url", "", "URL of gocacheprog serve instance used instead of redis, e.g. http://cache.example.com:8080")
+	serverToken    = flag.String("server-token", "", "bearer token of -server-url, comma separated tokens accepted by serve, or set them in "+serverTokenEnv)
+	progCommand    = flag.String("prog", "", "GOCACHEPROG command used as external storage instead of redis, e.g. \"go-cacher -cache-dir /mnt/cache\"")
+	pluginCommand  = flag.String("plugin", "", "plugin binary with its arguments used as external storage instead of redis, see plugin protocol in README")
+	peers          = flag.String("peers", "", "comma separated URLs of peers serving their local cache, keys are spread over them by rendezvous hashing")
+	peersFile      = flag.String("peers-file", "", "file with a peer URL per line, reloaded on change")
+	peerSelf       = flag.String("peer-self", "", "URL of this runner in the peer list")
+	peerListen     = flag.String("peer-listen", "", "address to serve -dir to peers on while the go command runs, e.g. :8081")
+	listen         = flag.String("listen", ":8080", "serve: address to listen on")
+	maxSize        = flag.String("max-size", "0", "serve: max size of -dir, e.g. 50GB, least recently used files are evicted above it, 0 disables eviction")
+	ttl            = flag.Duration("ttl", expiration, "TTL of redis and memcached entries, prolonged on every read and write")
+	dictSize       = flag.Int("dict-size", 110*1024, "train-dict: max size of dictionary")
+	dictSamples    = flag.Int("dict-samples", 10000, "train-dict: max count of sampled bodies")
+)
+
+const (
+	redisModeReadWrite  = "rw"
+	redisModeReadOnly   = "ro"
+	redisModeQuarantine = "quarantine"
+)
+
+const (
+	maxDictSampleSize = 64 * 1024
+	encryptKeysEnv    = "GOCACHEPROG_ENCRYPTION_KEYS"
+	httpTokenEnv      = "GOCACHEPROG_HTTP_TOKEN"
+	reapiTokenEnv     = "GOCACHEPROG_REAPI_TOKEN"
+	serverTokenEnv    = "GOCACHEPROG_SERVER_TOKEN"
 )
 
 type (
@@ -32,7 +94,8 @@ type (
 		OutputID []byte
 		DiskPath string
 		BodySize int64
-		Body     io.Reader
+		//Body is handed over to Put of the file system storage, or released with discardBody
+		Body io.Reader
 	}
 	PutRequest struct {
 		Key      string
@@ -45,17 +108,70 @@ type (
 		Get(ctx context.Context, key string) (GetResponse, bool, error)
 		//Put loads file, ensures that it exists at DiskPath, returns disk path
 		Put(ctx context.Context, request PutRequest) (string, error)
+		//Has cheaply checks that key is stored with outputID, without fetching body
+		Has(ctx context.Context, key string, outputID []byte) (bool, error)
 		Close(ctx context.Context) error
 	}
 )
 
+// main runs cache program, or command given as the first argument:
+//
+//	train-dict - trains zstd dictionary on local cache dir and publishes it to redis
+//	sign-keygen - generates key to sign redis entries
+//	invalidate - switches all runners to a clean redis keyspace
+//	namespaces - lists redis keyspaces with their sizes, deletes unused ones with -retire-days
+//	serve - serves -dir over HTTP as external storage of other runners, see -server-url
 func main() {
-	flag.Parse()
+	command, args := "", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	must0(flag.CommandLine.Parse(args))
+	switch command {
+	case "":
+		runCacheProg()
+	case "train-dict":
+		runTrainDict()
+	case "invalidate":
+		runInvalidate()
+	case "namespaces":
+		runNamespaces()
+	case "serve":
+		runServe()
+	case "sign-keygen":
+		_, signer := must2(ed25519.GenerateKey(nil))
+		fmt.Print(signKeyDescription(signer))
+	default:
+		flag.Usage()
+		log.Fatalf("unknown command: %s", command)
+	}
+}
+
+func runCacheProg() {
 	defer startTraceProfile()()
 	if *dir == "" {
 		flag.Usage()
 		log.Fatal("dir is required")
 	}
+	if *verify != verifyOff && *verify != verifyRemote && *verify != verifyAll {
+		flag.Usage()
+		log.Fatalf("invalid verify mode: %s", *verify)
+	}
+	if err := checkRedisMode(*redisMode, externalBackend()); err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	if _, err := parseCodec(*compressCodec); err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	if *peerListen != "" {
+		stop, err := startPeerServer(*peerListen, localStorage(), loadServerTokens())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer stop()
+	}
 	var inputReader io.Reader = os.Stdin
 	var outputWriter io.Writer = os.Stdout
 	if *logResponse {
@@ -69,6 +185,71 @@ func main() {
 		Run(ctx)
 }
 
+func runTrainDict() {
+	if *dir == "" {
+		flag.Usage()
+		log.Fatal("dir is required")
+	}
+	storage, err := connectExternalStorage()
+	if err != nil {
+		log.Fatalf("failed to connect to remote storage: %s", err)
+	}
+	defer storage.Close(context.Background())
+	d, err := trainDict(*dir, *dictSize, *dictSamples, maxDictSampleSize)
+	if err != nil {
+		log.Fatalf("failed to train dictionary: %s", err)
+	}
+	id, err := publishDict(context.Background(), storage, d)
+	if err != nil {
+		log.Fatalf("failed to publish dictionary: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "published dictionary %d of %s\n", id, humanSize(int64(len(d))))
+}
+
+func runInvalidate() {
+	client, err := connectRedis()
+	if err != nil {
+		log.Fatalf("failed to connect to redis server: %s", err)
+	}
+	defer client.Close()
+	epoch, err := bumpEpoch(context.Background(), client)
+	if err != nil {
+		log.Fatalf("failed to bump epoch: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "switched to epoch %d\n", epoch)
+}
+
+func runNamespaces() {
+	ctx := context.Background()
+	client, err := connectRedis()
+	if err != nil {
+		log.Fatalf("failed to connect to redis server: %s", err)
+	}
+	defer client.Close()
+	infos, err := listNamespaces(ctx, client)
+	if err != nil {
+		log.Fatalf("failed to list namespaces: %s", err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "Namespace\tLast Access\tKeys\tSize")
+	fmt.Fprint(w, formatNamespaces(infos))
+	must0(w.Flush())
+	if *retireDays <= 0 {
+		return
+	}
+	deadline := time.Now().AddDate(0, 0, -*retireDays)
+	for _, info := range infos {
+		if info.Root == "" || info.LastAccess.After(deadline) {
+			continue
+		}
+		deleted, err := deleteNamespace(ctx, client, info.Root)
+		if err != nil {
+			log.Fatalf("failed to delete namespace %s: %s", info.Root, err)
+		}
+		fmt.Fprintf(os.Stderr, "deleted %d keys of %s\n", deleted, info.Root)
+	}
+}
+
 func startTraceProfile() func() {
 	if *traceProfile == "" {
 		return func() {
@@ -84,35 +265,369 @@ func startTraceProfile() func() {
 }
 
 func buildStorage() Storage {
-	client, err := connectRedis()
+	externalStorage, err := connectExternalStorage()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to connect to redis server, switching to local file system: %s\n", err)
-		storage := NewFileSystemStorage(*dir)
-		if *compress {
-			storage = NewCompressStorage(storage)
-		}
+		fmt.Fprintf(os.Stderr, "failed to connect to remote storage, switching to local file system: %s\n", err)
+		storage := localStorage()
 		if *logMetrics {
 			return NewMetricsStorage(storage)
 		}
 		return NewLogStorage(storage)
 	}
 
-	storage := NewDecoratorStorage(
-		NewFileSystemStorage(*dir),
-		NewRedisStorage(
-			client,
-			*redisKeyPrefix,
-		),
-	)
+	//only the remote tier is compressed, files handed to the go command stay raw
 	if *compress {
-		storage = NewCompressStorage(storage)
+		externalStorage = NewCompressStorage(externalStorage, must(parseCodec(*compressCodec)), *compressLevel, *compressRatio)
+	}
+	if *signKey != "" || *trustedKeys != "" {
+		externalStorage = NewSignStorage(externalStorage, loadSigningKey(), loadTrustedSigningKeys())
+	}
+	if *redisMode == redisModeReadOnly {
+		externalStorage = NewReadOnlyStorage(externalStorage)
+	}
+	if *policyFile != "" {
+		externalStorage = NewPolicyStorage(externalStorage, loadPolicyFile())
 	}
+	//peers exchange raw bodies of their local storage, the remote keeps getting them through the wrappers above
+	if *peers != "" || *peersFile != "" {
+		var static []string
+		if *peers != "" {
+			static = strings.Split(*peers, ",")
+		}
+		externalStorage = must(NewPeerStorage(externalStorage, PeerOptions{
+			Peers: static,
+			File:  *peersFile,
+			Self:  *peerSelf,
+			Token: serverClientToken(),
+		}))
+	}
+	storage := NewDecoratorStorage(
+		localStorage(),
+		externalStorage,
+	)
 	if *logMetrics {
 		storage = NewMetricsStorage(storage)
 	}
 	return NewLogStorage(storage)
 }
 
+// localStorage opens -dir once, so the peer server and the local tier share the index
+var localStorage = sync.OnceValue(func() Storage {
+	if *dirIndex {
+		storage, err := NewIndexedFileSystemStorage(*dir, *verify == verifyAll)
+		if err == nil {
+			return storage
+		}
+		//parallel go commands share the dir, the index is held by the first one
+		fmt.Fprintf(os.Stderr, "failed to open index of %s, using index files: %s\n", *dir, err)
+	}
+	return NewFileSystemStorage(*dir, *verify == verifyAll)
+})
+
+// connectExternalStorage connects to S3, HTTP, REAPI, memcached, gocacheprog server, child cacheprog or plugin
+// if configured, otherwise to redis
+func connectExternalStorage() (Storage, error) {
+	var storage Storage
+	var err error
+	switch externalBackend() {
+	case "s3":
+		storage, err = connectS3()
+	case "http":
+		storage, err = connectHTTP()
+	case "reapi":
+		storage, err = connectREAPI()
+	case "memcached":
+		storage, err = connectMemcached()
+	case "serve":
+		storage, err = connectServer()
+	case "prog":
+		storage, err = connectProg()
+	case "plugin":
+		storage, err = connectPlugin()
+	default:
+		storage, err = connectRedisStorage()
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := loadEncryptionKeys()
+	if keys != nil {
+		storage = NewEncryptStorage(storage, keys)
+	}
+	return storage, nil
+}
+
+// externalBackend names the remote storage chosen by flags, redis unless another one is configured
+func externalBackend() string {
+	switch {
+	case *s3Endpoint != "":
+		return "s3"
+	case *httpURL != "":
+		return "http"
+	case *reapiURL != "":
+		return "reapi"
+	case *mcServers != "":
+		return "memcached"
+	case *serverURL != "":
+		return "serve"
+	case *progCommand != "":
+		return "prog"
+	case *pluginCommand != "":
+		return "plugin"
+	}
+	return "redis"
+}
+
+// checkRedisMode fails on modes the backend does not implement, only redis writes under the quarantine prefix
+func checkRedisMode(mode, backend string) error {
+	switch mode {
+	case redisModeReadWrite, redisModeReadOnly:
+		return nil
+	case redisModeQuarantine:
+		if backend != "redis" {
+			return fmt.Errorf("redis mode %s is not supported by %s storage", mode, backend)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid redis mode: %s", mode)
+}
+
+func connectS3() (Storage, error) {
+	storage, err := NewS3Storage(newHTTPClient(), S3Options{
+		Endpoint:     *s3Endpoint,
+		Bucket:       *s3Bucket,
+		Prefix:       *s3Prefix,
+		Region:       *s3Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		TempDir:      *dir,
+		Verify:       *verify != verifyOff,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = storage.(*s3Storage).ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func connectHTTP() (Storage, error) {
+	token := *httpToken
+	if token == "" {
+		token = os.Getenv(httpTokenEnv)
+	}
+	storage, err := NewHTTPStorage(newHTTPClient(), HTTPOptions{
+		URL:      *httpURL,
+		User:     *httpUser,
+		Password: *httpPassword,
+		Token:    token,
+		Retries:  *httpRetryCount,
+		Verify:   *verify != verifyOff,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = storage.(*httpStorage).ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func connectREAPI() (Storage, error) {
+	token := *reapiToken
+	if token == "" {
+		token = os.Getenv(reapiTokenEnv)
+	}
+	conn, err := dialREAPI(*reapiURL, token)
+	if err != nil {
+		return nil, err
+	}
+	storage := NewREAPIStorage(conn, REAPIOptions{
+		InstanceName: *reapiInstance,
+		Verify:       *verify != verifyOff,
+	})
+	err = storage.(*reapiStorage).ping(context.Background())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+func connectMemcached() (Storage, error) {
+	storage, err := NewMemcachedStorage(MemcachedOptions{
+		Servers:   strings.Split(*mcServers, ","),
+		KeyPrefix: *mcPrefix,
+		ItemSize:  *mcItemSize,
+		TTL:       *ttl,
+		//read-only builds do not prolong life of entries
+		KeepTTL: *redisMode == redisModeReadOnly,
+		Verify:  *verify != verifyOff,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = storage.(*memcachedStorage).ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+func connectServer() (Storage, error) {
+	storage, err := NewServerStorage(newHTTPClient(), HTTPOptions{
+		URL:     *serverURL,
+		Token:   serverClientToken(),
+		Retries: *httpRetryCount,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = storage.(*serverStorage).ping(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
+}
+
+// connectProg starts the child, its handshake proves it is running
+func connectProg() (Storage, error) {
+	return NewProgStorage(ProgOptions{
+		Command: strings.Fields(*progCommand),
+	})
+}
+
+// connectPlugin starts the plugin, its hello proves it is running
+func connectPlugin() (Storage, error) {
+	return NewPluginStorage(PluginOptions{
+		Command: strings.Fields(*pluginCommand),
+		TempDir: *dir,
+		Verify:  *verify != verifyOff,
+	})
+}
+
+// loadServerTokens returns tokens accepted by serve and peers, the first one is sent to them
+func loadServerTokens() []string {
+	tokens := *serverToken
+	if tokens == "" {
+		tokens = os.Getenv(serverTokenEnv)
+	}
+	if tokens == "" {
+		return nil
+	}
+	return strings.Split(tokens, ",")
+}
+
+func serverClientToken() string {
+	tokens := loadServerTokens()
+	if len(tokens) == 0 {
+		return ""
+	}
+	return tokens[0]
+}
+
+func connectRedisStorage() (Storage, error) {
+	client, err := connectRedis()
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := loadEpoch(context.Background(), client)
+	if err != nil {
+		return nil, err
+	}
+	options := RedisOptions{
+		KeyPrefix: *redisKeyPrefix,
+		Epoch:     epoch,
+		//read-only builds neither copy entries nor prolong their life
+		Promote: *redisPromote && *redisMode != redisModeReadOnly,
+		KeepTTL: *redisMode == redisModeReadOnly,
+		Verify:  *verify != verifyOff,
+		TTL:     *ttl,
+	}
+	if *redisReads != "" {
+		options.ReadPrefixes = strings.Split(*redisReads, ",")
+	}
+	if *redisMode == redisModeQuarantine {
+		options.WritePrefix = path.Join(*redisKeyPrefix, *redisQPrefix)
+	}
+	if *toolchainNS {
+		namespace, err := detectToolchain()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to detect toolchain, sharing keys with other toolchains: %s\n", err)
+		}
+		options.Namespace = namespace
+	}
+	//read-only builds leave no trace in redis
+	if *redisMode != redisModeReadOnly {
+		readRoots, writeRoot := options.roots()
+		err = touchNamespaces(context.Background(), client, append(readRoots, writeRoot)...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to record namespaces usage: %s\n", err)
+		}
+	}
+	return NewRedisStorage(client, options), nil
+}
+
+// loadEncryptionKeys returns nil if encryption is not configured
+func loadEncryptionKeys() *keyring {
+	var source io.Reader
+	if *encryptKeys != "" {
+		f := must(os.Open(*encryptKeys))
+		defer f.Close()
+		source = f
+	} else if env := os.Getenv(encryptKeysEnv); env != "" {
+		source = strings.NewReader(env)
+	} else {
+		return nil
+	}
+	keys, err := loadKeyring(source)
+	if err != nil {
+		log.Fatalf("failed to load encryption keys: %s", err)
+	}
+	return keys
+}
+
+func loadPolicyFile() *policy {
+	f := must(os.Open(*policyFile))
+	defer f.Close()
+	p, err := loadPolicy(f, os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+// loadSigningKey returns nil if signing key is not configured
+func loadSigningKey() ed25519.PrivateKey {
+	if *signKey == "" {
+		return nil
+	}
+	f := must(os.Open(*signKey))
+	defer f.Close()
+	signer, err := loadSigner(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return signer
+}
+
+func loadTrustedSigningKeys() []ed25519.PublicKey {
+	if *trustedKeys == "" {
+		return nil
+	}
+	f := must(os.Open(*trustedKeys))
+	defer f.Close()
+	keys, err := loadTrustedKeys(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return keys
+}
+
 func connectRedis() (redis.UniversalClient, error) {
 	client := redis.NewClusterClient(&redis.ClusterOptions{
 		Addrs:      strings.Split(*redisAddresses, ","),
@@ -146,6 +661,13 @@ func must[T any](t T, err error) T {
 	return t
 }
 
+func must2[T1, T2 any](t1 T1, t2 T2, err error) (T1, T2) {
+	if err != nil {
+		panic(err)
+	}
+	return t1, t2
+}
+
 func must0(err error) {
 	if err != nil {
 		panic(err)
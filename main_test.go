@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func Test_CheckRedisMode(t *testing.T) {
+	t.Run("quarantine is only supported by redis", func(t *testing.T) {
+		if err := checkRedisMode(redisModeQuarantine, "redis"); err != nil {
+			t.Fatal(err)
+		}
+		for _, backend := range []string{"s3", "http", "reapi", "memcached", "serve", "prog", "plugin"} {
+			if checkRedisMode(redisModeQuarantine, backend) == nil {
+				t.Fatal("expected quarantine to be rejected", backend)
+			}
+		}
+	})
+	t.Run("read-write and read-only are supported by every backend", func(t *testing.T) {
+		for _, backend := range []string{"redis", "s3", "memcached", "plugin"} {
+			for _, mode := range []string{redisModeReadWrite, redisModeReadOnly} {
+				if err := checkRedisMode(mode, backend); err != nil {
+					t.Fatal(mode, backend, err)
+				}
+			}
+		}
+	})
+	t.Run("unknown mode is rejected", func(t *testing.T) {
+		if checkRedisMode("rw,ro", "redis") == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
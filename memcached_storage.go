@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+)
+
+const (
+	//memcachedItemSize is the default item size limit of memcached, -I option
+	memcachedItemSize = 1024 * 1024
+	//memcachedItemOverhead is left in every item for its key and header
+	memcachedItemOverhead = 1024
+	memcachedTimeout      = 5 * time.Second
+	memcachedMaxIdle      = 8
+	//memcachedMaxRelativeTTL is the longest TTL memcached takes as relative, longer ones must be unix timestamps
+	memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+	//memcachedMaxChunks bounds chunks of a body, 64GB with the default item size
+	memcachedMaxChunks = 1 << 16
+)
+
+var (
+	memcachedUploadSkips      = expvar.NewInt("memcached_upload_skips")
+	memcachedUploadBytesSaved = expvar.NewInt("memcached_upload_bytes_saved")
+	errMemcachedRejected      = errors.New("rejected by server")
+)
+
+type (
+	// memcachedStorage keeps a meta item per ActionID and the body in content-addressed chunks fitting the item size limit,
+	// items are spread over servers by rendezvous hashing of their keys
+	memcachedStorage struct {
+		servers   map[string]*memcachedPool
+		hash      *rendezvous.Rendezvous
+		root      string
+		chunkSize int
+		ttl       time.Duration
+		keepTTL   bool
+		verify    bool
+	}
+	MemcachedOptions struct {
+		//Servers are addresses of memcached servers
+		Servers []string
+		//KeyPrefix namespaces keys
+		KeyPrefix string
+		//ItemSize is item size limit of servers, bodies are split into chunks below it, 1MB if 0
+		ItemSize int
+		//TTL of entries, expiration if 0
+		TTL time.Duration
+		//KeepTTL leaves TTL of read entries as is, so read-only builds do not write to memcached
+		KeepTTL bool
+		//Verify enables checking body hash on download
+		Verify bool
+	}
+	memcachedMeta struct {
+		meta
+		//Chunks is count of items of the body
+		Chunks int
+		//ChunkSize is size of all items of the body but the last one
+		ChunkSize int
+	}
+	// memcachedPool keeps idle connections to a server
+	memcachedPool struct {
+		address string
+		idle    chan *memcachedConn
+	}
+	memcachedConn struct {
+		net.Conn
+		rw *bufio.ReadWriter
+	}
+)
+
+func NewMemcachedStorage(options MemcachedOptions) (Storage, error) {
+	if len(options.Servers) == 0 {
+		return nil, errors.New("no memcached servers")
+	}
+	m := &memcachedStorage{
+		servers:   map[string]*memcachedPool{},
+		hash:      rendezvous.New(options.Servers, xxhash.Sum64String),
+		root:      keyRoot(options.KeyPrefix, "", 0),
+		chunkSize: options.ItemSize,
+		ttl:       options.TTL,
+		keepTTL:   options.KeepTTL,
+		verify:    options.Verify,
+	}
+	for _, address := range options.Servers {
+		m.servers[address] = &memcachedPool{address: address, idle: make(chan *memcachedConn, memcachedMaxIdle)}
+	}
+	if m.chunkSize <= 0 {
+		m.chunkSize = memcachedItemSize
+	}
+	m.chunkSize -= memcachedItemOverhead
+	if m.chunkSize <= 0 {
+		return nil, fmt.Errorf("memcached item size %d is too small", options.ItemSize)
+	}
+	if m.ttl <= 0 {
+		m.ttl = expiration
+	}
+	return m, nil
+}
+
+// ping checks that every server answers
+func (m *memcachedStorage) ping(_ context.Context) error {
+	for _, pool := range m.servers {
+		err := pool.do(func(c *memcachedConn) error {
+			_, err := c.command("version\r\n")
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("memcached %s: %w", pool.address, err)
+		}
+	}
+	return nil
+}
+
+func (m *memcachedStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return GetResponse{}, false, fmt.Errorf("empty key")
+	}
+	mm, ok, err := m.getMeta(key)
+	if err != nil || !ok {
+		return GetResponse{}, false, err
+	}
+	keys := m.chunkKeys(mm.Sum, mm.ChunkSize, mm.Chunks)
+	//reading chunks prolongs their life
+	command := "gat " + m.exptime(key) + " "
+	if m.keepTTL {
+		command = "get "
+	}
+	items, err := m.getMulti(command, keys)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("memcached chunks get error: %w %s", err, key)
+	}
+	var size int64
+	for _, k := range keys {
+		chunk, ok := items[k]
+		if !ok {
+			//chunk was evicted
+			return GetResponse{}, false, nil
+		}
+		size += int64(len(chunk))
+	}
+	if size != mm.Size {
+		return GetResponse{}, false, nil
+	}
+	body := make([]byte, 0, size)
+	for _, k := range keys {
+		body = append(body, items[k]...)
+	}
+	if m.verify {
+		ok, err := verifySum(bytes.NewReader(body), mm.Sum, mm.OutputID)
+		if err != nil {
+			return GetResponse{}, false, fmt.Errorf("memcached verify error: %w %s", err, key)
+		}
+		if !ok {
+			m.delete(append(keys, m.metaKey(key))...)
+			reportCorrupted("memcached", key)
+			return GetResponse{}, false, nil
+		}
+	}
+	return GetResponse{OutputID: mm.OutputID, BodySize: mm.Size, Body: bytes.NewReader(body)}, true, nil
+}
+
+func (m *memcachedStorage) getMeta(key string) (memcachedMeta, bool, error) {
+	items, err := m.getMulti("get ", []string{m.metaKey(key)})
+	if err != nil {
+		return memcachedMeta{}, false, fmt.Errorf("memcached metaGet error: %w %s", err, key)
+	}
+	b, ok := items[m.metaKey(key)]
+	if !ok {
+		return memcachedMeta{}, false, nil
+	}
+	var mm memcachedMeta
+	err = json.Unmarshal(b, &mm)
+	if err != nil {
+		return memcachedMeta{}, false, fmt.Errorf("memcached metaGet Unmarshal error: %w %s", err, key)
+	}
+	if !mm.valid() {
+		//meta is not trusted, its sizes are allocated
+		reportCorrupted("memcached", key)
+		m.delete(m.metaKey(key))
+		return memcachedMeta{}, false, nil
+	}
+	return mm, true, nil
+}
+
+// valid reports whether chunks of the meta add up to its size within limits
+func (mm memcachedMeta) valid() bool {
+	if mm.Size < 0 || mm.Size > maxDecodedSize || mm.ChunkSize <= 0 || mm.Chunks > memcachedMaxChunks {
+		return false
+	}
+	chunks := mm.Size / int64(mm.ChunkSize)
+	if mm.Size%int64(mm.ChunkSize) != 0 {
+		chunks++
+	}
+	//empty body has one empty chunk
+	return int64(mm.Chunks) == max(1, chunks)
+}
+
+func (m *memcachedStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	b, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("memcached bodyReadAll error: %w %s", err, request.Key)
+	}
+	sum := contentHash(b)
+	chunks := max(1, (len(b)+m.chunkSize-1)/m.chunkSize)
+	if chunks > memcachedMaxChunks {
+		return "", fmt.Errorf("memcached body of %d bytes needs %d chunks, above limit %d %s", len(b), chunks, memcachedMaxChunks, request.Key)
+	}
+	keys := m.chunkKeys(sum, m.chunkSize, chunks)
+	//body may be already uploaded by another action, it is uploaded again unless all of its chunks are left
+	stored := true
+	for _, k := range keys {
+		touched, err := m.touch(k, request.Key)
+		if err != nil {
+			return "", fmt.Errorf("memcached touch error: %w %s", err, request.Key)
+		}
+		if !touched {
+			stored = false
+			break
+		}
+	}
+	if stored {
+		memcachedUploadSkips.Add(1)
+		memcachedUploadBytesSaved.Add(int64(len(b)))
+	} else {
+		for i, k := range keys {
+			err = m.set(k, request.Key, b[i*m.chunkSize:min(len(b), (i+1)*m.chunkSize)])
+			if err != nil {
+				return "", fmt.Errorf("memcached set error: %w %s", err, request.Key)
+			}
+		}
+	}
+	metaBytes, err := json.Marshal(memcachedMeta{
+		meta:      meta{OutputID: request.OutputID, Size: int64(len(b)), Sum: sum},
+		Chunks:    chunks,
+		ChunkSize: m.chunkSize,
+	})
+	if err != nil {
+		return "", fmt.Errorf("memcached metaMarshal error: %w %s", err, request.Key)
+	}
+	err = m.set(m.metaKey(request.Key), request.Key, metaBytes)
+	if err != nil {
+		return "", fmt.Errorf("memcached set error: %w %s", err, request.Key)
+	}
+	//no disk path to return
+	return "", nil
+}
+
+func (m *memcachedStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	mm, ok, err := m.getMeta(key)
+	if err != nil || !ok || !bytes.Equal(mm.OutputID, outputID) {
+		return false, err
+	}
+	keys := append(m.chunkKeys(mm.Sum, mm.ChunkSize, mm.Chunks), m.metaKey(key))
+	if m.keepTTL {
+		//memcached tells whether an item exists only by touching or reading it
+		items, err := m.getMulti("get ", keys)
+		if err != nil {
+			return false, fmt.Errorf("memcached chunks get error: %w %s", err, key)
+		}
+		return len(items) == len(keys), nil
+	}
+	for _, k := range keys {
+		touched, err := m.touch(k, key)
+		if err != nil {
+			return false, fmt.Errorf("memcached touch error: %w %s", err, key)
+		}
+		if !touched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *memcachedStorage) Close(_ context.Context) error {
+	for _, pool := range m.servers {
+		pool.close()
+	}
+	return nil
+}
+
+// getMulti sends command with keys to their servers, one request per server, returns found items
+func (m *memcachedStorage) getMulti(command string, keys []string) (map[string][]byte, error) {
+	byServer := map[string][]string{}
+	for _, k := range keys {
+		server := m.hash.Lookup(k)
+		byServer[server] = append(byServer[server], k)
+	}
+	items := map[string][]byte{}
+	for server, serverKeys := range byServer {
+		err := m.servers[server].do(func(c *memcachedConn) error {
+			return c.retrieve(command+strings.Join(serverKeys, " ")+"\r\n", items)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+// set stores item k of entry key
+func (m *memcachedStorage) set(k, key string, value []byte) error {
+	return m.servers[m.hash.Lookup(k)].do(func(c *memcachedConn) error {
+		reply, err := c.command(fmt.Sprintf("set %s 0 %s %d\r\n", k, m.exptime(key), len(value)), value)
+		if err != nil {
+			return err
+		}
+		if reply != "STORED" {
+			return fmt.Errorf("%w: %s", errMemcachedRejected, reply)
+		}
+		return nil
+	})
+}
+
+// touch prolongs life of item k of entry key, returns false if it is absent
+func (m *memcachedStorage) touch(k, key string) (bool, error) {
+	var touched bool
+	err := m.servers[m.hash.Lookup(k)].do(func(c *memcachedConn) error {
+		reply, err := c.command(fmt.Sprintf("touch %s %s\r\n", k, m.exptime(key)))
+		touched = reply == "TOUCHED"
+		return err
+	})
+	return touched, err
+}
+
+// delete removes items, failures are only logged
+func (m *memcachedStorage) delete(keys ...string) {
+	for _, k := range keys {
+		err := m.servers[m.hash.Lookup(k)].do(func(c *memcachedConn) error {
+			_, err := c.command("delete " + k + "\r\n")
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "memcached delete error: %s %s\n", err, k)
+		}
+	}
+}
+
+// exptime returns TTL of entry key in memcached format, long ones as unix timestamp, 0 means none
+func (m *memcachedStorage) exptime(key string) string {
+	if isDictKey(key) {
+		return "0"
+	}
+	if m.ttl > memcachedMaxRelativeTTL {
+		return strconv.FormatInt(time.Now().Add(m.ttl).Unix(), 10)
+	}
+	return strconv.FormatInt(int64(m.ttl/time.Second), 10)
+}
+
+func (m *memcachedStorage) metaKey(key string) string {
+	return path.Join(m.root, key) + "-i"
+}
+
+// chunkKeys address chunks by content hash of the stored body and chunk size, so chunks of writes
+// differing in encryption, compression or item size limit are never mixed
+func (m *memcachedStorage) chunkKeys(sum []byte, chunkSize, chunks int) []string {
+	keys := make([]string, chunks)
+	for i := range keys {
+		keys[i] = path.Join(m.root, "o", hex.EncodeToString(sum), strconv.Itoa(chunkSize)+"-"+strconv.Itoa(i))
+	}
+	return keys
+}
+
+// do runs fn on an idle or new connection, connections failed by fn are dropped
+func (p *memcachedPool) do(fn func(c *memcachedConn) error) error {
+	var c *memcachedConn
+	select {
+	case c = <-p.idle:
+	default:
+		conn, err := net.DialTimeout("tcp", p.address, memcachedTimeout)
+		if err != nil {
+			return err
+		}
+		c = &memcachedConn{Conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	}
+	c.SetDeadline(time.Now().Add(memcachedTimeout))
+	err := fn(c)
+	//a rejected value leaves the connection in a known state
+	if err != nil && !errors.Is(err, errMemcachedRejected) {
+		c.Close()
+		return err
+	}
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+	return err
+}
+
+func (p *memcachedPool) close() {
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// command sends line followed by data blocks, returns the reply line
+func (c *memcachedConn) command(line string, data ...[]byte) (string, error) {
+	c.rw.WriteString(line)
+	for _, block := range data {
+		c.rw.Write(block)
+		c.rw.WriteString("\r\n")
+	}
+	err := c.rw.Flush()
+	if err != nil {
+		return "", err
+	}
+	return c.readLine()
+}
+
+// retrieve sends get or gat command and collects returned items until END
+func (c *memcachedConn) retrieve(line string, items map[string][]byte) error {
+	_, err := c.rw.WriteString(line)
+	if err == nil {
+		err = c.rw.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		reply, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if reply == "END" {
+			return nil
+		}
+		//VALUE <key> <flags> <bytes>
+		fields := strings.Fields(reply)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("unexpected reply: %s", reply)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("unexpected reply: %s", reply)
+		}
+		value := make([]byte, size+2)
+		_, err = io.ReadFull(c.rw, value)
+		if err != nil {
+			return err
+		}
+		items[fields[1]] = value[:size]
+	}
+}
+
+func (c *memcachedConn) readLine() (string, error) {
+	line, err := c.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		//the command was rejected, but the connection stays usable
+		return line, fmt.Errorf("%w: %s", errMemcachedRejected, line)
+	}
+	return line, nil
+}
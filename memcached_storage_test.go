@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_MemcachedStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Run("large body is chunked across servers", func(t *testing.T) {
+		servers := []*fakeMemcached{newFakeMemcached(t, 4096), newFakeMemcached(t, 4096)}
+		storage := must(NewMemcachedStorage(MemcachedOptions{
+			Servers:  []string{servers[0].address, servers[1].address},
+			ItemSize: 4096,
+			TTL:      time.Hour,
+			Verify:   true,
+		}))
+		defer storage.Close(ctx)
+		body := []byte(must(randomString(100_000)))
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: bytes.NewReader(body), BodySize: int64(len(body))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, server := range servers {
+			if len(server.items) < 5 {
+				t.Fatalf("expected chunks to be spread across servers, got %d items", len(server.items))
+			}
+			for key, exptime := range server.exptimes {
+				if exptime != 3600 {
+					t.Fatalf("expected TTL of an hour, got %d for %s", exptime, key)
+				}
+			}
+		}
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if string(get.OutputID) != "OutputID_1" || !bytes.Equal(must(io.ReadAll(get.Body)), body) {
+			t.Fatal("expected stored entry")
+		}
+		has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		_, ok, err = storage.Get(ctx, "ActionID_2")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("body shared by actions is uploaded once", func(t *testing.T) {
+		server := newFakeMemcached(t, memcachedItemSize)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}}))
+		defer storage.Close(ctx)
+		for _, key := range []string{"ActionID_1", "ActionID_2"} {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if server.sets != 3 {
+			t.Fatalf("expected one chunk and two meta items, got %d sets", server.sets)
+		}
+	})
+	t.Run("evicted chunk is a miss", func(t *testing.T) {
+		server := newFakeMemcached(t, 2048)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, ItemSize: 2048}))
+		defer storage.Close(ctx)
+		body := must(randomString(5000))
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: 5000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		for key := range server.items {
+			if strings.HasSuffix(key, "-1") {
+				delete(server.items, key)
+			}
+		}
+		server.mu.Unlock()
+		_, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+		has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+		if err != nil || has {
+			t.Fatal("expected not to have entry", err)
+		}
+	})
+	t.Run("chunks of different writes of an output are not mixed", func(t *testing.T) {
+		server := newFakeMemcached(t, 2048)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, ItemSize: 2048, Verify: true}))
+		defer storage.Close(ctx)
+		//encrypted or differently compressed bodies of the same output
+		bodies := map[string]string{"ActionID_1": must(randomString(5000)), "ActionID_2": must(randomString(5000))}
+		put := func(key string) {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader(bodies[key]), BodySize: 5000})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		put("ActionID_1")
+		server.mu.Lock()
+		for key := range server.items {
+			if strings.HasSuffix(key, "-1") {
+				delete(server.items, key)
+			}
+		}
+		server.mu.Unlock()
+		put("ActionID_2")
+		//the partially evicted body is uploaded whole again
+		put("ActionID_1")
+		for key, body := range bodies {
+			get, ok, err := storage.Get(ctx, key)
+			if err != nil || !ok || string(must(io.ReadAll(get.Body))) != body {
+				t.Fatalf("expected body of %s, %v", key, err)
+			}
+		}
+	})
+	t.Run("read-only reads keep TTL", func(t *testing.T) {
+		server := newFakeMemcached(t, 2048)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, ItemSize: 2048}))
+		defer storage.Close(ctx)
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(must(randomString(5000))), BodySize: 5000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		server.touches = 0
+		server.mu.Unlock()
+		storage = must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, ItemSize: 2048, KeepTTL: true}))
+		defer storage.Close(ctx)
+		if _, ok, err := storage.Get(ctx, "ActionID_1"); err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1")); err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if server.touches != 0 {
+			t.Fatalf("expected no touches, got %d", server.touches)
+		}
+	})
+	t.Run("dictionaries are stored without TTL", func(t *testing.T) {
+		server := newFakeMemcached(t, memcachedItemSize)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, TTL: time.Hour}))
+		defer storage.Close(ctx)
+		must(publishDict(ctx, storage, trainTestDict(t)))
+		for key, exptime := range server.exptimes {
+			if exptime != 0 {
+				t.Fatalf("expected no TTL, got %d for %s", exptime, key)
+			}
+		}
+	})
+	t.Run("bad meta is a miss", func(t *testing.T) {
+		server := newFakeMemcached(t, memcachedItemSize)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}}))
+		defer storage.Close(ctx)
+		metaKey := storage.(*memcachedStorage).metaKey("ActionID_1")
+		for _, bad := range []string{
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":-1,"Chunks":1,"ChunkSize":1024}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":5,"Chunks":-1,"ChunkSize":1024}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":5,"Chunks":1,"ChunkSize":0}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":5000,"Chunks":1,"ChunkSize":1024}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":0,"Chunks":0,"ChunkSize":1024}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":1099511627776,"Chunks":1,"ChunkSize":1099511627776}`,
+			`{"OutputID":"T3V0cHV0SURfMQ==","Size":1073741824,"Chunks":1073741824,"ChunkSize":1}`,
+		} {
+			server.mu.Lock()
+			server.items[metaKey] = []byte(bad)
+			server.mu.Unlock()
+			_, ok, err := storage.Get(ctx, "ActionID_1")
+			if err != nil || ok {
+				t.Fatal("expected miss", bad, err)
+			}
+			server.mu.Lock()
+			server.items[metaKey] = []byte(bad)
+			server.mu.Unlock()
+			has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+			if err != nil || has {
+				t.Fatal("expected not to have entry", bad, err)
+			}
+		}
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(""), BodySize: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected empty body to be found", err)
+		}
+	})
+	t.Run("item above server limit is rejected", func(t *testing.T) {
+		server := newFakeMemcached(t, 1024)
+		storage := must(NewMemcachedStorage(MemcachedOptions{Servers: []string{server.address}, ItemSize: 4096}))
+		defer storage.Close(ctx)
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(strings.Repeat("a", 2000)), BodySize: 2000})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err := storage.(*memcachedStorage).ping(ctx); err != nil {
+			t.Fatal("expected connection to stay usable", err)
+		}
+	})
+}
+
+// fakeMemcached serves the memcached text protocol commands used by memcachedStorage
+type fakeMemcached struct {
+	address  string
+	itemSize int
+	mu       sync.Mutex
+	items    map[string][]byte
+	exptimes map[string]int
+	sets     int
+	touches  int
+}
+
+func newFakeMemcached(t *testing.T, itemSize int) *fakeMemcached {
+	listener := must(net.Listen("tcp", "127.0.0.1:0"))
+	t.Cleanup(func() { listener.Close() })
+	f := &fakeMemcached{address: listener.Addr().String(), itemSize: itemSize, items: map[string][]byte{}, exptimes: map[string]int{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		f.mu.Lock()
+		switch {
+		case fields[0] == "set":
+			size := must(strconv.Atoi(fields[4]))
+			value := make([]byte, size+2)
+			io.ReadFull(rw, value)
+			if len(fields[1])+size > f.itemSize {
+				fmt.Fprint(rw, "SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			f.sets++
+			f.items[fields[1]] = value[:size]
+			f.exptimes[fields[1]] = must(strconv.Atoi(fields[3]))
+			fmt.Fprint(rw, "STORED\r\n")
+		case fields[0] == "get" || fields[0] == "gat":
+			keys := fields[1:]
+			if fields[0] == "gat" {
+				keys = fields[2:]
+			}
+			for _, key := range keys {
+				if value, ok := f.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+					if fields[0] == "gat" {
+						f.touches++
+					}
+				}
+			}
+			fmt.Fprint(rw, "END\r\n")
+		case fields[0] == "touch":
+			if _, ok := f.items[fields[1]]; ok {
+				f.touches++
+				fmt.Fprint(rw, "TOUCHED\r\n")
+			} else {
+				fmt.Fprint(rw, "NOT_FOUND\r\n")
+			}
+		case fields[0] == "delete":
+			delete(f.items, fields[1])
+			fmt.Fprint(rw, "DELETED\r\n")
+		case fields[0] == "version":
+			fmt.Fprint(rw, "VERSION 1.6.0\r\n")
+		default:
+			fmt.Fprint(rw, "ERROR\r\n")
+		}
+		f.mu.Unlock()
+		rw.Flush()
+	}
+}
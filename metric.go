@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"reflect"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"text/tabwriter"
@@ -34,8 +37,98 @@ type (
 		sync.Mutex
 		Storage
 	}
+	// metricsSnapshot is a consistent copy of metrics counters, served by the stats API
+	metricsSnapshot struct {
+		Gets         int64
+		Misses       int64
+		Puts         int64
+		Errors       int64
+		GetAvgTime   time.Duration
+		GetMaxTime   time.Duration
+		PutAvgTime   time.Duration
+		PutMaxTime   time.Duration
+		PutTotalSize int64
+	}
+	// compressionMetrics is fed by compressStorage for every artifact
+	compressionMetrics struct {
+		Artifacts     int64
+		Skipped       int64
+		RawSize       int64
+		StoredSize    int64
+		MinRatio      float64
+		MaxRatio      float64
+		EncodeTimeSum int64
+		EncodeMinTime int64
+		EncodeMaxTime int64
+		Decoded       int64
+		DecodeTimeSum int64
+		sync.Mutex
+	}
 )
 
+var compression = &compressionMetrics{
+	MinRatio:      math.MaxFloat64,
+	MaxRatio:      0,
+	EncodeMinTime: math.MaxInt64,
+	EncodeMaxTime: math.MinInt64,
+}
+
+func (c *compressionMetrics) observeEncode(rawSize, storedSize int64, elapsed time.Duration, skipped bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.Artifacts++
+	if skipped {
+		c.Skipped++
+	}
+	c.RawSize += rawSize
+	c.StoredSize += storedSize
+	if storedSize > 0 {
+		ratio := float64(rawSize) / float64(storedSize)
+		c.MinRatio = min(c.MinRatio, ratio)
+		c.MaxRatio = max(c.MaxRatio, ratio)
+	}
+	c.EncodeTimeSum += int64(elapsed)
+	c.EncodeMinTime = min(c.EncodeMinTime, int64(elapsed))
+	c.EncodeMaxTime = max(c.EncodeMaxTime, int64(elapsed))
+}
+
+func (c *compressionMetrics) observeDecode(elapsed time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.Decoded++
+	c.DecodeTimeSum += int64(elapsed)
+}
+
+func (c *compressionMetrics) print(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+	if c.Artifacts == 0 && c.Decoded == 0 {
+		return
+	}
+	fmt.Fprintln(w, "=== COMPRESSION ===")
+	fmt.Fprintln(w, "Metric\tValue\t")
+	fmt.Fprintln(w, "------\t-----\t")
+	fmt.Fprintf(w, "Compressed Artifacts\t%d\n", c.Artifacts)
+	fmt.Fprintf(w, "Stored Raw\t%d\n", c.Skipped)
+	if c.Artifacts > 0 {
+		fmt.Fprintf(w, "Raw Size\t%s\n", humanSize(c.RawSize))
+		fmt.Fprintf(w, "Stored Size\t%s\n", humanSize(c.StoredSize))
+		fmt.Fprintf(w, "Total Ratio\t%.2f\n", float64(c.RawSize)/float64(max(c.StoredSize, 1)))
+		fmt.Fprintf(w, "Min Ratio\t%.2f\n", c.MinRatio)
+		fmt.Fprintf(w, "Max Ratio\t%.2f\n", c.MaxRatio)
+		fmt.Fprintf(w, "Min Compress Time\t%s\n", time.Duration(c.EncodeMinTime).String())
+		fmt.Fprintf(w, "Max Compress Time\t%s\n", time.Duration(c.EncodeMaxTime).String())
+		fmt.Fprintf(w, "Avg Compress Time\t%s\n", time.Duration(safeDiv(c.EncodeTimeSum, c.Artifacts)).String())
+		fmt.Fprintf(w, "Total Compress Time\t%s\n", time.Duration(c.EncodeTimeSum).String())
+	}
+	fmt.Fprintf(w, "Decompressed Artifacts\t%d\n", c.Decoded)
+	if c.Decoded > 0 {
+		fmt.Fprintf(w, "Avg Decompress Time\t%s\n", time.Duration(safeDiv(c.DecodeTimeSum, c.Decoded)).String())
+		fmt.Fprintf(w, "Total Decompress Time\t%s\n", time.Duration(c.DecodeTimeSum).String())
+	}
+	fmt.Fprintln(w, "")
+}
+
 func NewMetricsStorage(storage Storage) Storage {
 	return &metrics{
 		DecoratedName: reflect.TypeOf(storage).String(),
@@ -60,10 +153,9 @@ func NewMetricsStorage(storage Storage) Storage {
 }
 
 func (s *metrics) Get(ctx context.Context, key string) (GetResponse, bool, error) {
-	s.Lock()
-	defer s.Unlock()
 	atomic.AddInt64(&s.GetCmd, 1)
 	now := time.Now()
+	//storage is called without the lock, so concurrent requests are not serialized behind a slow one
 	entry, ok, err := s.Storage.Get(ctx, key)
 	if !ok {
 		atomic.AddInt64(&s.GetMissCmd, 1)
@@ -72,6 +164,8 @@ func (s *metrics) Get(ctx context.Context, key string) (GetResponse, bool, error
 		atomic.AddInt64(&s.Errors, 1)
 	}
 	elapsed := int64(time.Since(now))
+	s.Lock()
+	defer s.Unlock()
 	s.GetCmdTimeSum += elapsed
 	s.GetCmdMinTime = min(s.GetCmdMinTime, elapsed)
 	s.GetCmdMaxTime = max(s.GetCmdMaxTime, elapsed)
@@ -79,8 +173,6 @@ func (s *metrics) Get(ctx context.Context, key string) (GetResponse, bool, error
 }
 
 func (s *metrics) Put(ctx context.Context, request PutRequest) (string, error) {
-	s.Lock()
-	defer s.Unlock()
 	atomic.AddInt64(&s.PutCmd, 1)
 	now := time.Now()
 	path, err := s.Storage.Put(ctx, request)
@@ -88,6 +180,8 @@ func (s *metrics) Put(ctx context.Context, request PutRequest) (string, error) {
 		atomic.AddInt64(&s.Errors, 1)
 	}
 	elapsed := int64(time.Since(now))
+	s.Lock()
+	defer s.Unlock()
 	s.PutCmdTimeSum += elapsed
 	s.PutCmdMinTime = min(s.PutCmdMinTime, elapsed)
 	s.PutCmdMaxTime = max(s.PutCmdMaxTime, elapsed)
@@ -97,6 +191,24 @@ func (s *metrics) Put(ctx context.Context, request PutRequest) (string, error) {
 	return path, err
 }
 
+// snapshot copies counters collected so far
+func (s *metrics) snapshot() metricsSnapshot {
+	s.Lock()
+	defer s.Unlock()
+	gets, puts := atomic.LoadInt64(&s.GetCmd), atomic.LoadInt64(&s.PutCmd)
+	return metricsSnapshot{
+		Gets:         gets,
+		Misses:       atomic.LoadInt64(&s.GetMissCmd),
+		Puts:         puts,
+		Errors:       atomic.LoadInt64(&s.Errors),
+		GetAvgTime:   time.Duration(max(safeDiv(s.GetCmdTimeSum, gets), 0)),
+		GetMaxTime:   time.Duration(max(s.GetCmdMaxTime, 0)),
+		PutAvgTime:   time.Duration(max(safeDiv(s.PutCmdTimeSum, puts), 0)),
+		PutMaxTime:   time.Duration(max(s.PutCmdMaxTime, 0)),
+		PutTotalSize: s.PutTotalSize,
+	}
+}
+
 func (s *metrics) Close(ctx context.Context) error {
 	s.Lock()
 	defer s.Unlock()
@@ -163,6 +275,26 @@ func (s *metrics) Close(ctx context.Context) error {
 		fmt.Fprintln(w, "Avg Size\tN/A")
 		fmt.Fprintln(w, "Total Size\tN/A")
 	}
+	fmt.Fprintln(w, "")
+
+	// Print compression stats table
+	compression.print(w)
+
+	// Print counters published by storages
+	fmt.Fprintln(w, "=== STORAGE COUNTERS ===")
+	fmt.Fprintln(w, "Metric\tValue\t")
+	fmt.Fprintln(w, "------\t-----\t")
+	expvar.Do(func(kv expvar.KeyValue) {
+		counter, ok := kv.Value.(*expvar.Int)
+		if !ok {
+			return
+		}
+		if strings.Contains(kv.Key, "bytes") {
+			fmt.Fprintf(w, "%s\t%s\n", kv.Key, humanSize(counter.Value()))
+			return
+		}
+		fmt.Fprintf(w, "%s\t%d\n", kv.Key, counter.Value())
+	})
 
 	return w.Flush()
 }
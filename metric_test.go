@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
@@ -55,3 +56,34 @@ func Test(t *testing.T) {
 	//func (m *MockStorage) Close(ctx context.Context) error {
 	//	return nil
 }
+
+func Test_MetricsConcurrency(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	mockStorage := NewMockStorage(ctrl)
+	var entered sync.WaitGroup
+	entered.Add(2)
+	//each get waits for the other one, so they deadlock if serialized
+	mockStorage.EXPECT().Get(gomock.Any(), gomock.Any()).DoAndReturn(func(context.Context, string) (GetResponse, bool, error) {
+		entered.Done()
+		entered.Wait()
+		return GetResponse{}, false, nil
+	}).Times(2)
+	metricsStorage := NewMetricsStorage(mockStorage)
+	done := make(chan struct{})
+	for range 2 {
+		go func() {
+			metricsStorage.Get(context.Background(), "key")
+			done <- struct{}{}
+		}()
+	}
+	for range 2 {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected concurrent gets not to be serialized")
+		}
+	}
+	if s := metricsStorage.(*metrics).snapshot(); s.Gets != 2 || s.Misses != 2 {
+		t.Fatalf("unexpected counters %+v", s)
+	}
+}
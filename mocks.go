@@ -70,6 +70,21 @@ func (mr *MockStorageMockRecorder) Get(ctx, key any) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockStorage)(nil).Get), ctx, key)
 }
 
+// Has mocks base method.
+func (m *MockStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Has", ctx, key, outputID)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Has indicates an expected call of Has.
+func (mr *MockStorageMockRecorder) Has(ctx, key, outputID any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Has", reflect.TypeOf((*MockStorage)(nil).Has), ctx, key, outputID)
+}
+
 // Put mocks base method.
 func (m *MockStorage) Put(ctx context.Context, request PutRequest) (string, error) {
 	m.ctrl.T.Helper()
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// namespacesKey maps root of every used keyspace to unix time of its last use,
+// keyspaces differ by prefix, toolchain namespace and epoch
+const namespacesKey = "gocacheprog/namespaces"
+
+type namespaceInfo struct {
+	Root       string
+	LastAccess time.Time
+	Keys       int64
+	Size       int64
+}
+
+// touchNamespaces records use of keyspaces by a build
+func touchNamespaces(ctx context.Context, cluster redis.UniversalClient, roots ...string) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	values := make([]any, 0, len(roots)*2)
+	for _, root := range roots {
+		values = append(values, root, now)
+	}
+	return cluster.HSet(ctx, namespacesKey, values...).Err()
+}
+
+// listNamespaces returns used keyspaces with their sizes, keys of no used keyspace are returned under empty root
+func listNamespaces(ctx context.Context, cluster redis.UniversalClient) ([]namespaceInfo, error) {
+	accesses, err := cluster.HGetAll(ctx, namespacesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos := map[string]*namespaceInfo{"": {}}
+	roots := make([]string, 0, len(accesses))
+	for root, access := range accesses {
+		unix, _ := strconv.ParseInt(access, 10, 64)
+		infos[root] = &namespaceInfo{Root: root, LastAccess: time.Unix(unix, 0)}
+		roots = append(roots, root)
+	}
+	//nested keyspaces go first, so key belongs to the most specific one
+	sort.Slice(roots, func(i, j int) bool { return len(roots[i]) > len(roots[j]) })
+	err = scanKeys(ctx, cluster, "gocacheprog/*", func(keys []string) error {
+		lengths := make([]*redis.IntCmd, len(keys))
+		_, err := cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				if !isControlKey(key) {
+					lengths[i] = pipe.StrLen(ctx, key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if lengths[i] == nil {
+				continue
+			}
+			info := infos[namespaceOf(roots, key)]
+			info.Keys++
+			info.Size += lengths[i].Val()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]namespaceInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Root < result[j].Root })
+	return result, nil
+}
+
+// deleteNamespace removes keys of keyspace, except keys of keyspaces nested in it
+// and control keys, which belong to the default root
+func deleteNamespace(ctx context.Context, cluster redis.UniversalClient, root string) (int64, error) {
+	accesses, err := cluster.HGetAll(ctx, namespacesKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	roots := make([]string, 0, len(accesses))
+	for r := range accesses {
+		roots = append(roots, r)
+	}
+	sort.Slice(roots, func(i, j int) bool { return len(roots[i]) > len(roots[j]) })
+	var deleted int64
+	err = scanKeys(ctx, cluster, root+"/*", func(keys []string) error {
+		_, err := cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				if namespaceOf(roots, key) == root && !isControlKey(key) {
+					pipe.Unlink(ctx, key)
+					deleted++
+				}
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, cluster.HDel(ctx, namespacesKey, root).Err()
+}
+
+// isControlKey reports whether key holds state of the cache rather than an entry
+func isControlKey(key string) bool {
+	return key == namespacesKey || key == epochKey
+}
+
+// namespaceOf returns the first of roots key belongs to, roots are sorted from the most specific
+func namespaceOf(roots []string, key string) string {
+	for _, root := range roots {
+		if strings.HasPrefix(key, root+"/") {
+			return root
+		}
+	}
+	return ""
+}
+
+// scanKeys iterates keys matching pattern on every master of cluster
+// with fn never called concurrently
+func scanKeys(ctx context.Context, cluster redis.UniversalClient, match string, fn func(keys []string) error) error {
+	var mu sync.Mutex
+	batch := func(keys []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return fn(keys)
+	}
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, match, 1000).Iterator()
+		var keys []string
+		for iter.Next(ctx) {
+			keys = append(keys, iter.Val())
+			if len(keys) == 1000 {
+				if err := batch(keys); err != nil {
+					return err
+				}
+				keys = keys[:0]
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		return batch(keys)
+	}
+	if c, ok := cluster.(*redis.ClusterClient); ok {
+		return c.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	}
+	return scan(ctx, cluster)
+}
+
+func formatNamespaces(infos []namespaceInfo) string {
+	b := &strings.Builder{}
+	for _, info := range infos {
+		root, access := info.Root, info.LastAccess.Format(time.DateTime)
+		if root == "" {
+			root, access = "(unregistered)", "-"
+		}
+		fmt.Fprintf(b, "%s\t%s\t%d\t%s\n", root, access, info.Keys, humanSize(info.Size))
+	}
+	return b.String()
+}
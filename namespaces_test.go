@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, redis.UniversalClient) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func Test_Namespaces(t *testing.T) {
+	ctx := context.Background()
+	t.Run("retiring default root keeps control keys", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		must(bumpEpoch(ctx, client))
+		must0(touchNamespaces(ctx, client, "gocacheprog", "gocacheprog/e1"))
+		must0(server.Set("gocacheprog/ActionID_1-i", "meta"))
+		must0(server.Set("gocacheprog/e1/ActionID_1-i", "meta"))
+		deleted, err := deleteNamespace(ctx, client, "gocacheprog")
+		if err != nil || deleted != 1 {
+			t.Fatalf("expected one key deleted, got %d %v", deleted, err)
+		}
+		if epoch, err := loadEpoch(ctx, client); err != nil || epoch != 1 {
+			t.Fatalf("expected epoch to be kept, got %d %v", epoch, err)
+		}
+		if !server.Exists("gocacheprog/e1/ActionID_1-i") || server.Exists("gocacheprog/ActionID_1-i") {
+			t.Fatal("expected only keys of default root to be deleted")
+		}
+		if fields, _ := server.HKeys(namespacesKey); len(fields) != 1 || fields[0] != "gocacheprog/e1" {
+			t.Fatalf("expected only default root to be unregistered, got %v", fields)
+		}
+	})
+	t.Run("keys belong to the most specific root", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		must0(touchNamespaces(ctx, client, "gocacheprog/main", "gocacheprog/main/go1.24.4-linux-amd64"))
+		must0(server.Set("gocacheprog/main/ActionID_1-i", "12345"))
+		must0(server.Set("gocacheprog/main/go1.24.4-linux-amd64/ActionID_1-i", "123"))
+		must0(server.Set("gocacheprog/branch/ActionID_1-i", "1"))
+		infos, err := listNamespaces(ctx, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []namespaceInfo{
+			{Root: "", Keys: 1, Size: 1},
+			{Root: "gocacheprog/main", Keys: 1, Size: 5},
+			{Root: "gocacheprog/main/go1.24.4-linux-amd64", Keys: 1, Size: 3},
+		}
+		if len(infos) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, infos)
+		}
+		for i, info := range infos {
+			if info.Root != expected[i].Root || info.Keys != expected[i].Keys || info.Size != expected[i].Size {
+				t.Fatalf("expected %v, got %v", expected[i], info)
+			}
+		}
+		deleted, err := deleteNamespace(ctx, client, "gocacheprog/main")
+		if err != nil || deleted != 1 {
+			t.Fatalf("expected one key deleted, got %d %v", deleted, err)
+		}
+		if !server.Exists("gocacheprog/main/go1.24.4-linux-amd64/ActionID_1-i") {
+			t.Fatal("expected nested keyspace to be kept")
+		}
+	})
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/dgryski/go-rendezvous"
+)
+
+const (
+	peerTimeout = 2 * time.Second
+	//peerDownTime is how long a failed peer is skipped, so a runner that finished its build does not slow others
+	peerDownTime = 30 * time.Second
+	//peerReloadInterval is how often the peers file is checked for changes
+	peerReloadInterval = 10 * time.Second
+)
+
+var (
+	peerHits   = expvar.NewInt("peer_hits")
+	peerMisses = expvar.NewInt("peer_misses")
+	peerErrors = expvar.NewInt("peer_errors")
+	peerPuts   = expvar.NewInt("peer_puts")
+	peerFills  = expvar.NewInt("peer_fills")
+)
+
+type (
+	// peerStorage looks keys up on the peer owning them before the remote storage, owners are chosen by
+	// rendezvous hashing, so every runner asks the same peer and a body crosses the WAN once per mesh
+	peerStorage struct {
+		Storage
+		self    string
+		static  []string
+		file    string
+		client  *http.Client
+		token   string
+		fills   sync.WaitGroup
+		mu      sync.Mutex
+		peers   map[string]Storage
+		hash    *rendezvous.Rendezvous
+		down    map[string]time.Time
+		modTime time.Time
+		checked time.Time
+	}
+	PeerOptions struct {
+		//Peers are URLs of peers serving their local storage
+		Peers []string
+		//File has a peer URL per line, it is reloaded on change, peers of the file are added to Peers
+		File string
+		//Self is URL of this runner in the peer list, its keys are not requested over the network
+		Self string
+		//Token is bearer token of peers
+		Token string
+		//Timeout of connecting to a peer and waiting for its response, 2 seconds by default
+		Timeout time.Duration
+	}
+	// peerFillBody spools a remote body to a temp file and uploads it to the owning peer once read to the end
+	peerFillBody struct {
+		source  io.Reader
+		body    io.Reader
+		file    *os.File
+		storage *peerStorage
+		peer    Storage
+		request PutRequest
+		size    int64
+		done    bool
+	}
+)
+
+// NewPeerStorage puts peers owning keys in front of remote
+func NewPeerStorage(remote Storage, options PeerOptions) (Storage, error) {
+	if options.Timeout == 0 {
+		options.Timeout = peerTimeout
+	}
+	transport := newHTTPClient().Transport.(*http.Transport)
+	transport.DialContext = (&net.Dialer{Timeout: options.Timeout}).DialContext
+	transport.ResponseHeaderTimeout = options.Timeout
+	p := &peerStorage{
+		Storage: remote,
+		self:    strings.TrimSuffix(options.Self, "/"),
+		static:  options.Peers,
+		file:    options.File,
+		client:  &http.Client{Transport: transport},
+		token:   options.Token,
+		peers:   map[string]Storage{},
+		down:    map[string]time.Time{},
+	}
+	err := p.setPeers(nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.file != "" {
+		err = p.reload(time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// reload reads peers file if it changed since the previous check
+func (p *peerStorage) reload(now time.Time) error {
+	p.checked = now
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read peers: %w", err)
+	}
+	if info.ModTime().Equal(p.modTime) {
+		return nil
+	}
+	f, err := os.Open(p.file)
+	if err != nil {
+		return fmt.Errorf("failed to read peers: %w", err)
+	}
+	defer f.Close()
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read peers: %w", err)
+	}
+	p.modTime = info.ModTime()
+	return p.setPeers(urls)
+}
+
+// setPeers hashes static peers and peers of the file, clients of known peers are reused
+func (p *peerStorage) setPeers(fromFile []string) error {
+	peers := map[string]Storage{}
+	var urls []string
+	for _, u := range append(append([]string{}, p.static...), fromFile...) {
+		u = strings.TrimSuffix(strings.TrimSpace(u), "/")
+		if _, ok := peers[u]; ok || u == "" {
+			continue
+		}
+		peer, ok := p.peers[u]
+		if !ok {
+			var err error
+			peer, err = NewServerStorage(p.client, HTTPOptions{URL: u, Token: p.token})
+			if err != nil {
+				return fmt.Errorf("invalid peer: %w", err)
+			}
+		}
+		peers[u] = peer
+		urls = append(urls, u)
+	}
+	p.peers, p.hash = peers, rendezvous.New(urls, xxhash.Sum64String)
+	return nil
+}
+
+// owner returns peer owning key, false if it is this runner or the peer is down
+func (p *peerStorage) owner(key string) (string, Storage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.file != "" && now.Sub(p.checked) > peerReloadInterval {
+		err := p.reload(now)
+		if err != nil {
+			//previous peers stay in use
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
+	u := p.hash.Lookup(key)
+	if u == "" || u == p.self || now.Before(p.down[u]) {
+		return "", nil, false
+	}
+	return u, p.peers[u], true
+}
+
+// fail skips peer for peerDownTime
+func (p *peerStorage) fail(u string, err error) {
+	peerErrors.Add(1)
+	fmt.Fprintf(os.Stderr, "peer %s failed, skipping it for %s: %s\n", u, peerDownTime, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[u] = time.Now().Add(peerDownTime)
+}
+
+func (p *peerStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	u, peer, owned := p.owner(key)
+	if owned {
+		resp, ok, err := peer.Get(ctx, key)
+		switch {
+		case err != nil:
+			p.fail(u, err)
+			owned = false
+		case ok && expectedSum(nil, resp.OutputID) == nil:
+			//only bodies whose OutputID is their content hash can be checked, others are taken from the remote
+			discardBody(resp.Body)
+			peerMisses.Add(1)
+		case ok:
+			peerHits.Add(1)
+			//peers are not trusted, a corrupted body fails its last read and is not stored
+			resp.Body = &streamBody{storage: "peer", key: key, body: readCloser(resp.Body), hash: newContentHash(), expected: resp.OutputID}
+			return resp, true, nil
+		default:
+			peerMisses.Add(1)
+		}
+	}
+	resp, ok, err := p.Storage.Get(ctx, key)
+	if err != nil || !ok || !owned || resp.Body == nil {
+		return resp, ok, err
+	}
+	//the next runner asking for the key gets it from the peer
+	file, err := os.CreateTemp("", "gocacheprog-peer-*")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to spool body for peer: %s\n", err)
+		return resp, true, nil
+	}
+	resp.Body = &peerFillBody{
+		source:  resp.Body,
+		body:    io.TeeReader(resp.Body, file),
+		file:    file,
+		storage: p,
+		peer:    peer,
+		request: PutRequest{Key: key, OutputID: resp.OutputID, BodySize: resp.BodySize},
+	}
+	return resp, true, nil
+}
+
+// Put stores request in the remote storage and in the peer owning its key,
+// a put dropped by the remote wrappers, e.g. in read-only mode, does not reach peers either
+func (p *peerStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	diskPath, err := p.Storage.Put(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	u, peer, owned := p.owner(request.Key)
+	body, ok := request.Body.(io.ReadSeeker)
+	if !owned || !ok {
+		return diskPath, nil
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	if err != nil {
+		return diskPath, nil
+	}
+	request.Body = body
+	_, err = peer.Put(ctx, request)
+	if err != nil {
+		p.fail(u, err)
+		return diskPath, nil
+	}
+	peerPuts.Add(1)
+	return diskPath, nil
+}
+
+// Has checks only the remote storage, as the answer decides whether the remote needs an upload
+func (p *peerStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	return p.Storage.Has(ctx, key, outputID)
+}
+
+func (p *peerStorage) Close(ctx context.Context) error {
+	p.fills.Wait()
+	p.client.CloseIdleConnections()
+	return p.Storage.Close(ctx)
+}
+
+func readCloser(body io.Reader) io.ReadCloser {
+	if c, ok := body.(io.ReadCloser); ok {
+		return c
+	}
+	return io.NopCloser(body)
+}
+
+// startPeerServer serves local storage to peers while the go command runs, returns function stopping it
+func startPeerServer(address string, storage Storage, tokens []string) (func(), error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cachePath, NewCacheHandler(storage, tokens, nil))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+	go server.Serve(listener)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), peerTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
+
+func (b *peerFillBody) Read(buf []byte) (int, error) {
+	n, err := b.body.Read(buf)
+	b.size += int64(n)
+	if err != nil && !b.done {
+		b.done = true
+		if errors.Is(err, io.EOF) {
+			b.fill()
+		} else {
+			b.discard()
+		}
+	}
+	return n, err
+}
+
+// fill uploads spooled body in background, a body cut short or corrupted is dropped
+func (b *peerFillBody) fill() {
+	if b.size != b.request.BodySize {
+		b.discard()
+		return
+	}
+	b.storage.fills.Add(1)
+	go func() {
+		defer b.storage.fills.Done()
+		defer b.discard()
+		_, err := b.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		b.request.Body = b.file
+		_, err = b.peer.Put(context.Background(), b.request)
+		if err != nil {
+			peerErrors.Add(1)
+			return
+		}
+		peerFills.Add(1)
+	}()
+}
+
+// Close drops the spooled body unless it is read to the end, and releases the remote one
+func (b *peerFillBody) Close() error {
+	if !b.done {
+		b.done = true
+		b.discard()
+	}
+	discardBody(b.source)
+	return nil
+}
+
+func (b *peerFillBody) discard() {
+	b.file.Close()
+	os.Remove(b.file.Name())
+}
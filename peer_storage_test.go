@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_PeerStorage(t *testing.T) {
+	ctx := context.Background()
+	outputID := contentHash([]byte("hello"))
+	newPeer := func(t *testing.T) (string, Storage) {
+		storage := NewFileSystemStorage(t.TempDir(), false)
+		server := httptest.NewServer(NewCacheHandler(storage, []string{"secret"}, nil))
+		t.Cleanup(server.Close)
+		return server.URL, storage
+	}
+	newRemote := func(t *testing.T) Storage {
+		u, _ := newPeer(t)
+		return must(NewServerStorage(newHTTPClient(), HTTPOptions{URL: u, Token: "secret"}))
+	}
+	put := func(t *testing.T, storage Storage, key string) {
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(t *testing.T, storage Storage, key string) {
+		resp, ok, err := storage.Get(ctx, key)
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if !bytes.Equal(resp.OutputID, outputID) || string(must(io.ReadAll(resp.Body))) != "hello" {
+			t.Fatal("expected stored entry")
+		}
+	}
+	t.Run("remote hit fills owning peer", func(t *testing.T) {
+		u1, peer1 := newPeer(t)
+		u2, peer2 := newPeer(t)
+		remoteURL, remoteDir := newPeer(t)
+		remote := must(NewServerStorage(newHTTPClient(), HTTPOptions{URL: remoteURL, Token: "secret"}))
+		put(t, remote, "ActionID_1")
+		storage := must(NewPeerStorage(remote, PeerOptions{Peers: []string{u1, u2}, Token: "secret"}))
+		get(t, storage, "ActionID_1")
+		storage.(*peerStorage).fills.Wait()
+		owner, _, _ := storage.(*peerStorage).owner("ActionID_1")
+		ownerStorage := map[string]Storage{u1: peer1, u2: peer2}[owner]
+		if has, err := ownerStorage.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+			t.Fatal("expected owner to be filled", err)
+		}
+		//the next hit can come only from the peer
+		must0(os.Remove(remoteDir.(*fileSystemStorage).indexName("ActionID_1")))
+		get(t, storage, "ActionID_1")
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("put stores in remote and owning peer", func(t *testing.T) {
+		u, peer := newPeer(t)
+		remote := newRemote(t)
+		storage := must(NewPeerStorage(remote, PeerOptions{Peers: []string{u}, Token: "secret"}))
+		put(t, storage, "ActionID_1")
+		for _, s := range []Storage{remote, peer} {
+			if has, err := s.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+				t.Fatal("expected to have entry", err)
+			}
+		}
+	})
+	t.Run("corrupted peer body is rejected", func(t *testing.T) {
+		u, peer := newPeer(t)
+		_, err := peer.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: outputID, Body: strings.NewReader("jello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := must(NewPeerStorage(newRemote(t), PeerOptions{Peers: []string{u}, Token: "secret"}))
+		resp, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected peer hit", err)
+		}
+		if _, err := io.ReadAll(resp.Body); !errors.Is(err, errCorruptedBody) {
+			t.Fatal("expected corrupted body", err)
+		}
+	})
+	t.Run("put dropped by remote is not sent to peer", func(t *testing.T) {
+		u, peer := newPeer(t)
+		storage := must(NewPeerStorage(NewReadOnlyStorage(newRemote(t)), PeerOptions{Peers: []string{u}, Token: "secret"}))
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: outputID, Body: strings.NewReader("hello"), BodySize: 5})
+		if !errors.Is(err, errPutDropped) {
+			t.Fatal("expected put to be dropped", err)
+		}
+		if has, err := peer.Has(ctx, "ActionID_1", outputID); err != nil || has {
+			t.Fatal("expected peer not to have entry", err)
+		}
+	})
+	t.Run("own keys are not requested", func(t *testing.T) {
+		remote := newRemote(t)
+		put(t, remote, "ActionID_1")
+		self, requests := newCountingServer(t)
+		storage := must(NewPeerStorage(remote, PeerOptions{Peers: []string{self}, Self: self}))
+		get(t, storage, "ActionID_1")
+		if requests.Load() != 0 {
+			t.Fatal("expected no requests to self")
+		}
+	})
+	t.Run("failed peer is skipped", func(t *testing.T) {
+		remote := newRemote(t)
+		put(t, remote, "ActionID_1")
+		failing, requests := newCountingServer(t)
+		storage := must(NewPeerStorage(remote, PeerOptions{Peers: []string{failing}, Timeout: time.Second}))
+		for range 2 {
+			get(t, storage, "ActionID_1")
+		}
+		if requests.Load() != 1 {
+			t.Fatalf("expected peer to be skipped after failure, got %d requests", requests.Load())
+		}
+	})
+	t.Run("peers file is reloaded", func(t *testing.T) {
+		file := path.Join(t.TempDir(), "peers")
+		must0(os.WriteFile(file, []byte("# runners\nhttp://runner-1:8081\n"), 0644))
+		storage := must(NewPeerStorage(newRemote(t), PeerOptions{Peers: []string{"http://static:8081"}, File: file})).(*peerStorage)
+		if len(storage.peers) != 2 {
+			t.Fatalf("expected static and file peers, got %v", storage.peers)
+		}
+		must0(os.WriteFile(file, []byte("http://runner-2:8081/\n"), 0644))
+		later := time.Now().Add(time.Minute)
+		must0(os.Chtimes(file, later, later))
+		must0(storage.reload(time.Now()))
+		if _, ok := storage.peers["http://runner-2:8081"]; !ok || len(storage.peers) != 2 {
+			t.Fatalf("expected runner-1 to be replaced by runner-2, got %v", storage.peers)
+		}
+	})
+}
+
+// newCountingServer fails every request, counting them
+func newCountingServer(t *testing.T) (string, *atomic.Int64) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, &requests
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Plugin protocol, version 1. See "Plugin protocol" in README.md.
+const (
+	pluginProtocol = "gocacheprog-plugin"
+	pluginVersion  = 1
+	pluginOpGet    = "get"
+	pluginOpPut    = "put"
+	pluginOpHas    = "has"
+	pluginOpDelete = "delete"
+	pluginOpClose  = "close"
+	//pluginVersionsEnv tells the plugin which protocol versions gocacheprog speaks
+	pluginVersionsEnv = "GOCACHEPROG_PLUGIN_VERSIONS"
+	//pluginDirEnv is the dir body files are exchanged in
+	pluginDirEnv = "GOCACHEPROG_PLUGIN_DIR"
+)
+
+const (
+	pluginStartTimeout = 10 * time.Second
+	pluginCloseTimeout = 30 * time.Second
+	//pluginRestartDelay keeps a crashing plugin from being restarted in a loop
+	pluginRestartDelay = time.Second
+)
+
+var (
+	pluginRestarts = expvar.NewInt("plugin_restarts")
+	errPluginExit  = errors.New("plugin exited")
+)
+
+type (
+	// pluginHello is the first line written by the plugin
+	pluginHello struct {
+		Protocol string
+		Version  int
+		Ops      []string
+	}
+	// pluginRequest is a line written to the plugin, bodies are passed in files at Path
+	pluginRequest struct {
+		ID       int64
+		Op       string
+		Key      string `json:",omitempty"`
+		OutputID []byte `json:",omitempty"`
+		Size     int64  `json:",omitempty"`
+		//Sum is content hash of the body file of a put, the plugin returns it with get
+		Sum  []byte `json:",omitempty"`
+		Path string `json:",omitempty"`
+	}
+	// pluginResponse is a line written by the plugin, in any order, with ID of its request
+	pluginResponse struct {
+		ID       int64
+		Error    string `json:",omitempty"`
+		Found    bool   `json:",omitempty"`
+		OutputID []byte `json:",omitempty"`
+		Size     int64  `json:",omitempty"`
+		Sum      []byte `json:",omitempty"`
+	}
+	// pluginStorage is an external tier served by a plugin binary over the plugin protocol,
+	// a plugin that exits is restarted on the next request
+	pluginStorage struct {
+		command []string
+		dir     string
+		verify  bool
+		stderr  io.Writer
+		nextID  atomic.Int64
+		mu      sync.Mutex
+		process *pluginProcess
+		started time.Time
+	}
+	PluginOptions struct {
+		//Command is the plugin binary and its arguments
+		Command []string
+		//TempDir holds the dir of body files, set it to the cache dir so bodies are moved rather than copied
+		TempDir string
+		//Stderr receives stderr of the plugin, os.Stderr by default
+		Stderr io.Writer
+		//Verify checks bodies against the content hash sent with put, entries of plugins not returning it are not verified,
+		//OutputID is not used as bodies may be transformed by compression or encryption
+		Verify bool
+	}
+	// pluginProcess is one run of the plugin
+	pluginProcess struct {
+		cmd     *exec.Cmd
+		stdin   io.WriteCloser
+		ops     []string
+		writeMu sync.Mutex
+		mu      sync.Mutex
+		pending map[int64]chan pluginResponse
+		err     error
+		done    chan struct{}
+	}
+)
+
+// NewPluginStorage starts the plugin and checks its hello
+func NewPluginStorage(options PluginOptions) (Storage, error) {
+	if len(options.Command) == 0 {
+		return nil, errors.New("empty plugin command")
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
+	dir, err := os.MkdirTemp(options.TempDir, "plugin-*")
+	if err != nil {
+		return nil, fmt.Errorf("plugin dir error: %w", err)
+	}
+	p := &pluginStorage{command: options.Command, dir: dir, verify: options.Verify, stderr: options.Stderr}
+	p.process, err = p.start()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return p, nil
+}
+
+// start runs the plugin and waits for its hello
+func (p *pluginStorage) start() (*pluginProcess, error) {
+	p.started = time.Now()
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Stderr = p.stderr
+	cmd.Env = append(os.Environ(), pluginVersionsEnv+"="+strconv.Itoa(pluginVersion), pluginDirEnv+"="+p.dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin stdin error: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("plugin stdout error: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("plugin start error: %w", err)
+	}
+	decoder := json.NewDecoder(bufio.NewReader(stdout))
+	hello := make(chan error, 1)
+	var h pluginHello
+	go func() {
+		hello <- decoder.Decode(&h)
+	}()
+	select {
+	case err = <-hello:
+	case <-time.After(pluginStartTimeout):
+		err = errors.New("no hello")
+	}
+	switch {
+	case err != nil:
+	case h.Protocol != pluginProtocol:
+		err = fmt.Errorf("unknown protocol %q", h.Protocol)
+	case h.Version != pluginVersion:
+		err = fmt.Errorf("unsupported version %d, supported %d", h.Version, pluginVersion)
+	case !slices.Contains(h.Ops, pluginOpGet) || !slices.Contains(h.Ops, pluginOpPut):
+		err = fmt.Errorf("get and put are not supported, ops: %v", h.Ops)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("plugin hello error: %w", err)
+	}
+	process := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		ops:     h.Ops,
+		pending: map[int64]chan pluginResponse{},
+		done:    make(chan struct{}),
+	}
+	go process.read(decoder)
+	return process, nil
+}
+
+// running returns the plugin process, restarting it if it exited
+func (p *pluginStorage) running() (*pluginProcess, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.process.done:
+	default:
+		return p.process, nil
+	}
+	p.process.cmd.Wait()
+	time.Sleep(time.Until(p.started.Add(pluginRestartDelay)))
+	process, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	pluginRestarts.Add(1)
+	fmt.Fprintf(os.Stderr, "plugin %s restarted\n", p.command[0])
+	p.process = process
+	return process, nil
+}
+
+// roundTrip sends request, retrying it once on a restarted plugin if the plugin exits,
+// all operations are idempotent
+func (p *pluginStorage) roundTrip(ctx context.Context, request pluginRequest) (pluginResponse, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var process *pluginProcess
+		process, err = p.running()
+		if err != nil {
+			return pluginResponse{}, err
+		}
+		if !slices.Contains(process.ops, request.Op) {
+			return pluginResponse{}, fmt.Errorf("plugin does not support %s", request.Op)
+		}
+		request.ID = p.nextID.Add(1)
+		var resp pluginResponse
+		resp, err = process.roundTrip(ctx, request)
+		if !errors.Is(err, errPluginExit) {
+			return resp, err
+		}
+	}
+	return pluginResponse{}, err
+}
+
+func (p *pluginStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	bodyPath := p.bodyPath()
+	resp, err := p.roundTrip(ctx, pluginRequest{Op: pluginOpGet, Key: key, Path: bodyPath})
+	if err != nil || !resp.Found {
+		os.Remove(bodyPath)
+		return GetResponse{}, false, wrapPluginError(pluginOpGet, key, err)
+	}
+	f, err := os.Open(bodyPath)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("plugin body error: %w %s", err, key)
+	}
+	//Size is of the raw body, the file may be compressed or encrypted, so its size is not checked
+	body := tempFileBody{File: f}
+	if p.verify && len(resp.Sum) != 0 {
+		ok, err := verifySum(f, resp.Sum, nil)
+		if err == nil && !ok {
+			body.discard()
+			reportCorrupted("plugin", key)
+			p.Delete(ctx, key)
+			return GetResponse{}, false, nil
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			body.discard()
+			return GetResponse{}, false, fmt.Errorf("plugin body error: %w %s", err, key)
+		}
+	}
+	return GetResponse{OutputID: resp.OutputID, BodySize: resp.Size, Body: body}, true, nil
+}
+
+func (p *pluginStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	bodyPath := p.bodyPath()
+	defer os.Remove(bodyPath)
+	sum, err := writePluginBody(bodyPath, request.Body)
+	if err != nil {
+		return "", fmt.Errorf("plugin body error: %w %s", err, request.Key)
+	}
+	_, err = p.roundTrip(ctx, pluginRequest{
+		Op:       pluginOpPut,
+		Key:      request.Key,
+		OutputID: request.OutputID,
+		Size:     request.BodySize,
+		Sum:      sum,
+		Path:     bodyPath,
+	})
+	//no disk path to return
+	return "", wrapPluginError(pluginOpPut, request.Key, err)
+}
+
+// Has falls back to get for plugins without has, the body file is dropped
+func (p *pluginStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	request := pluginRequest{Op: pluginOpHas, Key: key, OutputID: outputID}
+	if process, err := p.running(); err == nil && !slices.Contains(process.ops, pluginOpHas) {
+		request = pluginRequest{Op: pluginOpGet, Key: key, Path: p.bodyPath()}
+		defer os.Remove(request.Path)
+	}
+	resp, err := p.roundTrip(ctx, request)
+	if err != nil {
+		return false, wrapPluginError(request.Op, key, err)
+	}
+	return resp.Found && (request.Op == pluginOpHas || bytes.Equal(resp.OutputID, outputID)), nil
+}
+
+// Delete removes key from the plugin storage, it is used for corrupted entries
+func (p *pluginStorage) Delete(ctx context.Context, key string) error {
+	_, err := p.roundTrip(ctx, pluginRequest{Op: pluginOpDelete, Key: key})
+	return wrapPluginError(pluginOpDelete, key, err)
+}
+
+// Close asks the plugin to exit, killing it if it does not in time
+func (p *pluginStorage) Close(ctx context.Context) error {
+	defer os.RemoveAll(p.dir)
+	ctx, cancel := context.WithTimeout(ctx, pluginCloseTimeout)
+	defer cancel()
+	p.mu.Lock()
+	process := p.process
+	p.mu.Unlock()
+	var err error
+	if slices.Contains(process.ops, pluginOpClose) {
+		_, err = process.roundTrip(ctx, pluginRequest{ID: p.nextID.Add(1), Op: pluginOpClose})
+		if errors.Is(err, errPluginExit) {
+			//nothing to close
+			err = nil
+		}
+	}
+	process.stdin.Close()
+	select {
+	case <-process.done:
+	case <-ctx.Done():
+		process.cmd.Process.Kill()
+		<-process.done
+	}
+	process.cmd.Wait()
+	return wrapPluginError(pluginOpClose, "", err)
+}
+
+func (p *pluginStorage) bodyPath() string {
+	return path.Join(p.dir, strconv.FormatInt(p.nextID.Add(1), 10))
+}
+
+// writePluginBody writes body file of a put, the plugin sees it only once the file is complete,
+// returns content hash of the file
+func writePluginBody(bodyPath string, body io.Reader) ([]byte, error) {
+	f, err := os.Create(bodyPath)
+	if err != nil {
+		return nil, err
+	}
+	h := newContentHash()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h.Sum(nil), f.Close()
+}
+
+func wrapPluginError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("plugin %s error: %w %s", op, err, key)
+}
+
+// read dispatches responses to their requests until the plugin exits
+func (p *pluginProcess) read(decoder *json.Decoder) {
+	defer close(p.done)
+	for {
+		var resp pluginResponse
+		err := decoder.Decode(&resp)
+		p.mu.Lock()
+		if err != nil {
+			p.err = fmt.Errorf("%w: %w", errPluginExit, err)
+			for id, ch := range p.pending {
+				close(ch)
+				delete(p.pending, id)
+			}
+			p.mu.Unlock()
+			return
+		}
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+func (p *pluginProcess) roundTrip(ctx context.Context, request pluginRequest) (pluginResponse, error) {
+	ch := make(chan pluginResponse, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return pluginResponse{}, p.err
+	}
+	p.pending[request.ID] = ch
+	p.mu.Unlock()
+	b := must(json.Marshal(request))
+	p.writeMu.Lock()
+	_, err := p.stdin.Write(append(b, '\n'))
+	p.writeMu.Unlock()
+	if err != nil {
+		p.mu.Lock()
+		delete(p.pending, request.ID)
+		p.mu.Unlock()
+		//a plugin that stopped reading is restarted
+		p.cmd.Process.Kill()
+		return pluginResponse{}, fmt.Errorf("%w: %w", errPluginExit, err)
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return pluginResponse{}, p.err
+		}
+		if resp.Error != "" {
+			return pluginResponse{}, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.pending, request.ID)
+		p.mu.Unlock()
+		return pluginResponse{}, ctx.Err()
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	pluginChildDirEnv = "GOCACHEPROG_TEST_PLUGIN_DIR"
+	//pluginCrashEnv makes the plugin exit on receiving the given request, once
+	pluginCrashEnv   = "GOCACHEPROG_TEST_PLUGIN_CRASH"
+	pluginVersionEnv = "GOCACHEPROG_TEST_PLUGIN_VERSION"
+)
+
+// Test_PluginHelperProcess is the plugin of pluginStorage tests, it keeps entries in files
+func Test_PluginHelperProcess(t *testing.T) {
+	dir := os.Getenv(pluginChildDirEnv)
+	if dir == "" {
+		return
+	}
+	version := pluginVersion
+	if v := os.Getenv(pluginVersionEnv); v != "" {
+		version = must(strconv.Atoi(v))
+	}
+	crashAt, _ := strconv.Atoi(os.Getenv(pluginCrashEnv))
+	crashed := path.Join(dir, "crashed")
+	encoder := json.NewEncoder(os.Stdout)
+	must0(encoder.Encode(pluginHello{Protocol: pluginProtocol, Version: version, Ops: []string{"get", "put", "has", "delete", "close"}}))
+	scanner := bufio.NewScanner(os.Stdin)
+	for requests := 1; scanner.Scan(); requests++ {
+		var request pluginRequest
+		must0(json.Unmarshal(scanner.Bytes(), &request))
+		if requests == crashAt && !isFileExists(crashed) {
+			must0(os.WriteFile(crashed, nil, 0644))
+			os.Exit(1)
+		}
+		resp, err := servePluginRequest(dir, request)
+		resp.ID = request.ID
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		must0(encoder.Encode(resp))
+		if request.Op == pluginOpClose {
+			break
+		}
+	}
+	os.Exit(0)
+}
+
+func servePluginRequest(dir string, request pluginRequest) (pluginResponse, error) {
+	name := path.Join(dir, hex.EncodeToString([]byte(request.Key)))
+	var stored pluginResponse
+	if request.Op == pluginOpGet || request.Op == pluginOpHas {
+		b, err := os.ReadFile(name + "-meta")
+		if errors.Is(err, os.ErrNotExist) {
+			return pluginResponse{}, nil
+		}
+		if err != nil {
+			return pluginResponse{}, err
+		}
+		must0(json.Unmarshal(b, &stored))
+		stored.Found = true
+	}
+	switch request.Op {
+	case pluginOpGet:
+		return stored, os.WriteFile(request.Path, must(os.ReadFile(name+"-body")), 0644)
+	case pluginOpHas:
+		return pluginResponse{Found: string(stored.OutputID) == string(request.OutputID)}, nil
+	case pluginOpPut:
+		must0(os.WriteFile(name+"-body", must(os.ReadFile(request.Path)), 0644))
+		return pluginResponse{}, os.WriteFile(name+"-meta", must(json.Marshal(pluginResponse{OutputID: request.OutputID, Size: request.Size, Sum: request.Sum})), 0644)
+	case pluginOpDelete:
+		os.Remove(name + "-meta")
+		return pluginResponse{}, nil
+	case pluginOpClose:
+		return pluginResponse{}, nil
+	}
+	return pluginResponse{}, fmt.Errorf("unknown op %s", request.Op)
+}
+
+func newTestPluginStorage(t *testing.T, dir string) *pluginStorage {
+	t.Setenv(pluginChildDirEnv, dir)
+	storage := must(NewPluginStorage(PluginOptions{
+		Command: []string{os.Args[0], "-test.run=^Test_PluginHelperProcess$"},
+		TempDir: t.TempDir(),
+		Verify:  true,
+	}))
+	return storage.(*pluginStorage)
+}
+
+func Test_PluginStorage(t *testing.T) {
+	ctx := context.Background()
+	body := "hello"
+	outputID := contentHash([]byte(body))
+	put := func(t *testing.T, storage Storage, key string) {
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader(body), BodySize: int64(len(body))})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("round trip through temp files", func(t *testing.T) {
+		storage := newTestPluginStorage(t, t.TempDir())
+		put(t, storage, "ActionID_1")
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if _, ok := get.Body.(tempFileBody); !ok {
+			t.Fatal("expected body in temp file to be moved by file system storage")
+		}
+		if string(get.OutputID) != string(outputID) || string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected stored entry")
+		}
+		get.Body.(tempFileBody).discard()
+		has, err := storage.Has(ctx, "ActionID_1", outputID)
+		if err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		must0(storage.Delete(ctx, "ActionID_1"))
+		_, ok, err = storage.Get(ctx, "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if isFileExists(storage.dir) {
+			t.Fatal("expected body dir to be removed")
+		}
+	})
+	t.Run("compressed entry is verified against its sum", func(t *testing.T) {
+		plugin := newTestPluginStorage(t, t.TempDir())
+		defer plugin.Close(ctx)
+		storage := NewCompressStorage(plugin, codecZstd, 0, 0)
+		put(t, storage, "ActionID_1")
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok || string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected to be found", err)
+		}
+		if n := len(must(os.ReadDir(plugin.dir))); n != 0 {
+			t.Fatalf("expected body file to be released, got %d files", n)
+		}
+		if has, err := plugin.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+			t.Fatal("expected entry to be kept", err)
+		}
+	})
+	t.Run("crashed plugin is restarted", func(t *testing.T) {
+		t.Setenv(pluginCrashEnv, "2")
+		storage := newTestPluginStorage(t, t.TempDir())
+		defer storage.Close(ctx)
+		restarts := pluginRestarts.Value()
+		put(t, storage, "ActionID_1")
+		has, err := storage.Has(ctx, "ActionID_1", outputID)
+		if err != nil || !has {
+			t.Fatal("expected request to be retried on restarted plugin", err)
+		}
+		if pluginRestarts.Value()-restarts < 1 {
+			t.Fatal("expected one restart")
+		}
+	})
+	t.Run("corrupted entry is deleted", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := newTestPluginStorage(t, dir)
+		defer storage.Close(ctx)
+		put(t, storage, "ActionID_1")
+		must0(os.WriteFile(path.Join(dir, hex.EncodeToString([]byte("ActionID_1"))+"-body"), []byte("jello"), 0644))
+		_, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+		if isFileExists(path.Join(dir, hex.EncodeToString([]byte("ActionID_1"))+"-meta")) {
+			t.Fatal("expected entry to be deleted")
+		}
+	})
+	t.Run("unsupported version is rejected", func(t *testing.T) {
+		t.Setenv(pluginVersionEnv, "2")
+		t.Setenv(pluginChildDirEnv, t.TempDir())
+		_, err := NewPluginStorage(PluginOptions{Command: []string{os.Args[0], "-test.run=^Test_PluginHelperProcess$"}})
+		if err == nil || !strings.Contains(err.Error(), "unsupported version") {
+			t.Fatal("expected version error", err)
+		}
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+const (
+	effectAllow = "allow"
+	effectDeny  = "deny"
+)
+
+// branchEnvs are checked in order to find out branch of the build
+var branchEnvs = []string{"CI_COMMIT_REF_NAME", "GITHUB_HEAD_REF", "GITHUB_REF_NAME", "BRANCH_NAME", "GIT_BRANCH"}
+
+var (
+	policyAllowed = expvar.NewInt("policy_allowed_puts")
+	policyDenied  = expvar.NewInt("policy_denied_puts")
+)
+
+type (
+	// policyConfig decides which builds may write to the remote cache, e.g.
+	//
+	//	{
+	//	  "default": "deny",
+	//	  "dirty_marker": ".git/gocacheprog-dirty",
+	//	  "rules": [
+	//	    {"effect": "deny", "dirty": true},
+	//	    {"effect": "deny", "max_size": 104857600},
+	//	    {"effect": "allow", "env": {"CI_COMMIT_REF_PROTECTED": "true"}},
+	//	    {"effect": "allow", "branch": "main|release/.*"}
+	//	  ]
+	//	}
+	//
+	// The first rule whose conditions all hold decides, default applies if none does.
+	policyConfig struct {
+		Default     string       `json:"default"`
+		DirtyMarker string       `json:"dirty_marker"`
+		Rules       []policyRule `json:"rules"`
+	}
+	policyRule struct {
+		Effect string `json:"effect"`
+		//Branch is regexp the whole branch of the build must match
+		Branch string `json:"branch,omitempty"`
+		//Env maps variable name to regexp its whole value must match
+		Env map[string]string `json:"env,omitempty"`
+		//Dirty matches presence of dirty worktree marker
+		Dirty *bool `json:"dirty,omitempty"`
+		//MinSize and MaxSize bound artifact size in bytes
+		MinSize *int64 `json:"min_size,omitempty"`
+		MaxSize *int64 `json:"max_size,omitempty"`
+	}
+	// policy is config evaluated against the environment at startup, only sizes are left for every put
+	policy struct {
+		defaultAllow bool
+		rules        []evaluatedRule
+	}
+	evaluatedRule struct {
+		index   int
+		allow   bool
+		minSize *int64
+		maxSize *int64
+	}
+	policyStorage struct {
+		Storage
+		policy *policy
+	}
+)
+
+func loadPolicy(r io.Reader, getenv func(string) string) (*policy, error) {
+	var config policyConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy: %w", err)
+	}
+	defaultAllow, err := parseEffect(config.Default, effectAllow)
+	if err != nil {
+		return nil, err
+	}
+	p := &policy{defaultAllow: defaultAllow}
+	branch := buildBranch(getenv)
+	dirty := config.DirtyMarker != "" && isFileExists(config.DirtyMarker)
+	for i, rule := range config.Rules {
+		allow, err := parseEffect(rule.Effect, "")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		matched, err := rule.matchEnvironment(branch, dirty, getenv)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if matched {
+			p.rules = append(p.rules, evaluatedRule{index: i + 1, allow: allow, minSize: rule.MinSize, maxSize: rule.MaxSize})
+		}
+	}
+	return p, nil
+}
+
+func parseEffect(effect, defaultEffect string) (bool, error) {
+	if effect == "" {
+		effect = defaultEffect
+	}
+	switch effect {
+	case effectAllow:
+		return true, nil
+	case effectDeny:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid effect: %q", effect)
+}
+
+func buildBranch(getenv func(string) string) string {
+	for _, env := range branchEnvs {
+		if branch := getenv(env); branch != "" {
+			return branch
+		}
+	}
+	return ""
+}
+
+func (r policyRule) matchEnvironment(branch string, dirty bool, getenv func(string) string) (bool, error) {
+	if r.Branch != "" {
+		re, err := regexp.Compile("^(?:" + r.Branch + ")$")
+		if err != nil {
+			return false, fmt.Errorf("invalid branch: %w", err)
+		}
+		if !re.MatchString(branch) {
+			return false, nil
+		}
+	}
+	for name, value := range r.Env {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return false, fmt.Errorf("invalid env %s: %w", name, err)
+		}
+		if !re.MatchString(getenv(name)) {
+			return false, nil
+		}
+	}
+	if r.Dirty != nil && *r.Dirty != dirty {
+		return false, nil
+	}
+	return true, nil
+}
+
+// decide returns whether artifact of size may be written, and why
+func (p *policy) decide(size int64) (bool, string) {
+	for _, rule := range p.rules {
+		if rule.minSize != nil && size < *rule.minSize || rule.maxSize != nil && size > *rule.maxSize {
+			continue
+		}
+		return rule.allow, fmt.Sprintf("rule %d", rule.index)
+	}
+	return p.defaultAllow, "default"
+}
+
+// startupDecision describes decision if it doesn't depend on artifact
+func (p *policy) startupDecision() (bool, string, error) {
+	for _, rule := range p.rules {
+		if rule.minSize != nil || rule.maxSize != nil {
+			return false, "", errors.New("depends on artifact size")
+		}
+		return rule.allow, fmt.Sprintf("rule %d", rule.index), nil
+	}
+	return p.defaultAllow, "default", nil
+}
+
+func effectName(allow bool) string {
+	if allow {
+		return effectAllow
+	}
+	return effectDeny
+}
+
+// NewPolicyStorage drops puts to decorated storage denied by policy, logging every decision
+func NewPolicyStorage(storage Storage, p *policy) Storage {
+	allow, reason, err := p.startupDecision()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "policy: remote writes %s\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "policy: %s remote writes by %s\n", effectName(allow), reason)
+	}
+	return &policyStorage{Storage: storage, policy: p}
+}
+
+func (p policyStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	allow, reason := p.policy.decide(request.BodySize)
+	fmt.Fprintf(os.Stderr, "policy: %s put %s of %d bytes by %s\n", effectName(allow), request.Key, request.BodySize, reason)
+	if !allow {
+		policyDenied.Add(1)
+		return "", errPutDropped
+	}
+	policyAllowed.Add(1)
+	return p.Storage.Put(ctx, request)
+}
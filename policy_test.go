@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_Policy(t *testing.T) {
+	const config = `{
+		"default": "deny",
+		"dirty_marker": %q,
+		"rules": [
+			{"effect": "deny", "dirty": true},
+			{"effect": "deny", "min_size": 1000},
+			{"effect": "allow", "env": {"CI_COMMIT_REF_PROTECTED": "true"}},
+			{"effect": "allow", "branch": "main|release/.*"}
+		]
+	}`
+	marker := path.Join(t.TempDir(), "dirty")
+	load := func(t *testing.T, env map[string]string) *policy {
+		p, err := loadPolicy(strings.NewReader(fmt.Sprintf(config, marker)), func(name string) string {
+			return env[name]
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tests := []struct {
+		name  string
+		env   map[string]string
+		dirty bool
+		size  int64
+		allow bool
+	}{
+		{name: "protected branch", env: map[string]string{"CI_COMMIT_REF_PROTECTED": "true"}, size: 10, allow: true},
+		{name: "release branch", env: map[string]string{"CI_COMMIT_REF_NAME": "release/1.2"}, size: 10, allow: true},
+		{name: "feature branch", env: map[string]string{"CI_COMMIT_REF_NAME": "feature/1"}, size: 10, allow: false},
+		{name: "main branch", env: map[string]string{"CI_COMMIT_REF_NAME": "main"}, size: 10, allow: true},
+		{name: "branch containing main", env: map[string]string{"CI_COMMIT_REF_NAME": "feature/main-fix"}, size: 10, allow: false},
+		{name: "branch ending with main", env: map[string]string{"CI_COMMIT_REF_NAME": "not-main"}, size: 10, allow: false},
+		{name: "branch containing release", env: map[string]string{"CI_COMMIT_REF_NAME": "feature/release/1"}, size: 10, allow: false},
+		{name: "large artifact", env: map[string]string{"CI_COMMIT_REF_PROTECTED": "true"}, size: 1000, allow: false},
+		{name: "dirty worktree", env: map[string]string{"CI_COMMIT_REF_PROTECTED": "true"}, dirty: true, size: 10, allow: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(marker)
+			if tt.dirty {
+				must0(os.WriteFile(marker, nil, 0644))
+			}
+			allow, _ := load(t, tt.env).decide(tt.size)
+			if allow != tt.allow {
+				t.Fatalf("expected %v", tt.allow)
+			}
+		})
+	}
+	t.Run("denied put is dropped", func(t *testing.T) {
+		os.Remove(marker)
+		external := newMemoryStorage()
+		storage := NewPolicyStorage(external, load(t, nil))
+		_, err := storage.Put(context.Background(), PutRequest{Key: "ActionID_1", Body: strings.NewReader("hello"), BodySize: 5})
+		if !errors.Is(err, errPutDropped) {
+			t.Fatal("expected put to be reported as dropped", err)
+		}
+		if len(external.bodies) != 0 {
+			t.Fatal("expected put to be dropped")
+		}
+	})
+	t.Run("invalid config", func(t *testing.T) {
+		for _, config := range []string{`{"default": "maybe"}`, `{"rules": [{"effect": "allow", "branch": "("}]}`, `{"rule": []}`} {
+			_, err := loadPolicy(strings.NewReader(config), os.Getenv)
+			if err == nil {
+				t.Fatal("expected error", config)
+			}
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	progStartTimeout = 10 * time.Second
+	progCloseTimeout = 30 * time.Second
+)
+
+type (
+	// progStorage is an external tier served by a child GOCACHEPROG program over the cacheprog protocol,
+	// so other cacheprog implementations get local storage, decorators and metrics of this one
+	progStorage struct {
+		cmd     *exec.Cmd
+		stdin   io.WriteCloser
+		writer  *bufio.Writer
+		writeMu sync.Mutex
+		nextID  atomic.Int64
+		known   []Cmd
+		mu      sync.Mutex
+		pending map[int64]chan Response
+		//err is set when the child stopped answering
+		err  error
+		done chan struct{}
+	}
+	ProgOptions struct {
+		//Command is the program and its arguments, as GOCACHEPROG without splitting
+		Command []string
+		//Stderr receives stderr of the child, os.Stderr by default
+		Stderr io.Writer
+	}
+)
+
+// NewProgStorage starts the child and waits for its handshake
+func NewProgStorage(options ProgOptions) (Storage, error) {
+	if len(options.Command) == 0 {
+		return nil, errors.New("empty cacheprog command")
+	}
+	if options.Stderr == nil {
+		options.Stderr = os.Stderr
+	}
+	cmd := exec.Command(options.Command[0], options.Command[1:]...)
+	cmd.Stderr = options.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cacheprog stdin error: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("cacheprog stdout error: %w", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("cacheprog start error: %w", err)
+	}
+	p := &progStorage{
+		cmd:     cmd,
+		stdin:   stdin,
+		writer:  bufio.NewWriter(stdin),
+		pending: map[int64]chan Response{},
+		done:    make(chan struct{}),
+	}
+	decoder := json.NewDecoder(bufio.NewReader(stdout))
+	handshake := make(chan error, 1)
+	go func() {
+		var resp Response
+		err := decoder.Decode(&resp)
+		p.known = resp.KnownCommands
+		handshake <- err
+	}()
+	select {
+	case err = <-handshake:
+	case <-time.After(progStartTimeout):
+		err = errors.New("no handshake")
+	}
+	if err == nil && (!slices.Contains(p.known, CmdGet) || !slices.Contains(p.known, CmdPut)) {
+		err = fmt.Errorf("get and put are not supported, known commands: %v", p.known)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("cacheprog handshake error: %w", err)
+	}
+	go p.read(decoder)
+	return p, nil
+}
+
+// read dispatches responses to their requests, answered out of order, until the child exits
+func (p *progStorage) read(decoder *json.Decoder) {
+	defer close(p.done)
+	for {
+		var resp Response
+		err := decoder.Decode(&resp)
+		p.mu.Lock()
+		if err != nil {
+			p.err = fmt.Errorf("cacheprog stopped answering: %w", err)
+			for id, ch := range p.pending {
+				close(ch)
+				delete(p.pending, id)
+			}
+			p.mu.Unlock()
+			return
+		}
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// roundTrip sends request and waits for its response
+func (p *progStorage) roundTrip(ctx context.Context, request Request) (Response, error) {
+	request.ID = p.nextID.Add(1)
+	ch := make(chan Response, 1)
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return Response{}, p.err
+	}
+	p.pending[request.ID] = ch
+	p.mu.Unlock()
+	err := p.write(request)
+	if err != nil {
+		p.mu.Lock()
+		delete(p.pending, request.ID)
+		p.mu.Unlock()
+		return Response{}, err
+	}
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return Response{}, p.err
+		}
+		if resp.Err != "" {
+			return Response{}, errors.New(resp.Err)
+		}
+		return resp, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		delete(p.pending, request.ID)
+		p.mu.Unlock()
+		return Response{}, ctx.Err()
+	}
+}
+
+// write sends request line followed by body as base64 JSON string, streamed as the go command does
+func (p *progStorage) write(request Request) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	p.writer.Write(append(b, '\n'))
+	if request.BodySize > 0 {
+		p.writer.WriteByte('"')
+		encoder := base64.NewEncoder(base64.StdEncoding, p.writer)
+		n, err := io.Copy(encoder, request.Body)
+		encoder.Close()
+		if err == nil && n != request.BodySize {
+			err = fmt.Errorf("body size %d, expected %d", n, request.BodySize)
+		}
+		if err != nil {
+			//the stream is broken in the middle of the body
+			p.cmd.Process.Kill()
+			return fmt.Errorf("cacheprog body error: %w", err)
+		}
+		p.writer.WriteString("\"\n")
+	}
+	err = p.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("cacheprog write error: %w", err)
+	}
+	return nil
+}
+
+func (p *progStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	resp, err := p.get(ctx, key)
+	if err != nil || resp.Miss {
+		return GetResponse{}, false, err
+	}
+	//the file belongs to the child until close, so it is copied rather than moved
+	f, err := os.Open(resp.DiskPath)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("cacheprog body error: %w %s", err, key)
+	}
+	//bodies are not verified, the protocol keeps no content hash and OutputID is not one of compressed or encrypted bodies
+	return GetResponse{OutputID: resp.OutputID, BodySize: resp.Size, Body: &streamBody{storage: "cacheprog", key: key, body: f}}, true, nil
+}
+
+func (p *progStorage) get(ctx context.Context, key string) (Response, error) {
+	resp, err := p.roundTrip(ctx, Request{Command: CmdGet, ActionID: progActionID(key)})
+	if err != nil {
+		return Response{}, fmt.Errorf("cacheprog get error: %w %s", err, key)
+	}
+	return resp, nil
+}
+
+func (p *progStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	_, err := p.roundTrip(ctx, Request{
+		Command:  CmdPut,
+		ActionID: progActionID(request.Key),
+		OutputID: request.OutputID,
+		Body:     request.Body,
+		BodySize: request.BodySize,
+	})
+	if err != nil {
+		return "", fmt.Errorf("cacheprog put error: %w %s", err, request.Key)
+	}
+	//disk path of the child is not ours to hand out
+	return "", nil
+}
+
+// Has asks for the entry with get, as the protocol has no cheaper command
+func (p *progStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	resp, err := p.get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return !resp.Miss && bytes.Equal(resp.OutputID, outputID), nil
+}
+
+// Close asks the child to exit, killing it if it does not in time
+func (p *progStorage) Close(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, progCloseTimeout)
+	defer cancel()
+	var err error
+	if slices.Contains(p.known, CmdClose) {
+		_, err = p.roundTrip(ctx, Request{Command: CmdClose})
+	}
+	p.stdin.Close()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+	waitErr := p.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("cacheprog close error: %w", err)
+	}
+	if waitErr != nil {
+		return fmt.Errorf("cacheprog exit error: %w", waitErr)
+	}
+	return nil
+}
+
+// progActionID returns key as ActionID, hashing keys that are not one, such as dictionary ones
+func progActionID(key string) []byte {
+	return must(hex.DecodeString(actionHash(key)))
+}
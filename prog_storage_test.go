@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+const progChildDirEnv = "GOCACHEPROG_TEST_CHILD_DIR"
+
+// Test_ProgHelperProcess is the child cacheprog of progStorage tests, it serves a file system storage
+func Test_ProgHelperProcess(t *testing.T) {
+	dir := os.Getenv(progChildDirEnv)
+	if dir == "" {
+		return
+	}
+	NewApp(os.Stdin, os.Stdout, hex.EncodeToString, NewFileSystemStorage(dir, false)).Run(context.Background())
+	os.Exit(0)
+}
+
+func newTestProgStorage(t *testing.T) *progStorage {
+	t.Setenv(progChildDirEnv, t.TempDir())
+	storage := must(NewProgStorage(ProgOptions{Command: []string{os.Args[0], "-test.run=^Test_ProgHelperProcess$"}}))
+	return storage.(*progStorage)
+}
+
+func Test_ProgStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Run("round trip through child", func(t *testing.T) {
+		storage := newTestProgStorage(t)
+		body := must(randomString(100_000))
+		outputID := contentHash([]byte(body))
+		for _, key := range []string{hex.EncodeToString(contentHash([]byte("ActionID_1"))), dictKey(1)} {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader(body), BodySize: int64(len(body))})
+			if err != nil {
+				t.Fatal(err)
+			}
+			get, ok, err := storage.Get(ctx, key)
+			if err != nil || !ok {
+				t.Fatal("expected to be found", err)
+			}
+			if string(get.OutputID) != string(outputID) || get.BodySize != int64(len(body)) || string(must(io.ReadAll(get.Body))) != body {
+				t.Fatal("expected stored entry")
+			}
+			has, err := storage.Has(ctx, key, outputID)
+			if err != nil || !has {
+				t.Fatal("expected to have entry", err)
+			}
+		}
+		_, err := storage.Put(ctx, PutRequest{Key: "empty", OutputID: []byte("OutputID_1"), Body: strings.NewReader(""), BodySize: 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := storage.Get(ctx, hex.EncodeToString(contentHash([]byte("ActionID_2"))))
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("compressed entry round trip", func(t *testing.T) {
+		prog := newTestProgStorage(t)
+		storage := NewCompressStorage(prog, codecZstd, 0, 0)
+		body := strings.Repeat(must(randomString(100)), 100)
+		outputID := contentHash([]byte(body))
+		key := hex.EncodeToString(contentHash([]byte("ActionID_1")))
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader(body), BodySize: int64(len(body))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get, ok, err := storage.Get(ctx, key)
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if get.BodySize != int64(len(body)) || string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected stored entry")
+		}
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("crashed child fails requests", func(t *testing.T) {
+		storage := newTestProgStorage(t)
+		must0(storage.cmd.Process.Kill())
+		<-storage.done
+		_, _, err := storage.Get(ctx, "ActionID_1")
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		storage.Close(ctx)
+	})
+	t.Run("program without cacheprog handshake is rejected", func(t *testing.T) {
+		_, err := NewProgStorage(ProgOptions{Command: []string{"true"}})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
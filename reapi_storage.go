@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	//reapiBatchLimit keeps batch requests well below the default 4MB gRPC message limit,
+	//larger blobs go through ByteStream
+	reapiBatchLimit = 1024 * 1024
+	reapiChunkSize  = 256 * 1024
+	reapiOutputPath = "output"
+	reapiWorker     = "gocacheprog"
+)
+
+var (
+	reapiUploadSkips      = expvar.NewInt("reapi_upload_skips")
+	reapiUploadBytesSaved = expvar.NewInt("reapi_upload_bytes_saved")
+)
+
+type (
+	// reapiStorage keeps ActionID as ActionResult of the action cache, whose only output file points at the body in CAS,
+	// so a body is uploaded once for all actions producing it
+	reapiStorage struct {
+		ac          repb.ActionCacheClient
+		cas         repb.ContentAddressableStorageClient
+		byteStream  bytestream.ByteStreamClient
+		instance    string
+		batchLimit  int64
+		verify      bool
+		closeClient func() error
+	}
+	// bearerToken authorizes every call, it requires TLS
+	bearerToken  string
+	REAPIOptions struct {
+		//InstanceName selects instance of the server, may be empty
+		InstanceName string
+		//BatchLimit is size of blobs above which ByteStream is used, 1MB if 0
+		BatchLimit int64
+		//Verify enables checking body hash on download
+		Verify bool
+	}
+)
+
+// NewREAPIStorage uses ActionCache, ContentAddressableStorage and ByteStream services of conn,
+// which is closed by Close if it is a *grpc.ClientConn
+func NewREAPIStorage(conn grpc.ClientConnInterface, options REAPIOptions) Storage {
+	r := &reapiStorage{
+		ac:          repb.NewActionCacheClient(conn),
+		cas:         repb.NewContentAddressableStorageClient(conn),
+		byteStream:  bytestream.NewByteStreamClient(conn),
+		instance:    options.InstanceName,
+		batchLimit:  options.BatchLimit,
+		verify:      options.Verify,
+		closeClient: func() error { return nil },
+	}
+	if r.batchLimit <= 0 {
+		r.batchLimit = reapiBatchLimit
+	}
+	if c, ok := conn.(*grpc.ClientConn); ok {
+		r.closeClient = c.Close
+	}
+	return r
+}
+
+// dialREAPI connects to target given as grpc://host:port or grpcs://host:port for TLS
+func dialREAPI(target, token string) (*grpc.ClientConn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid reapi target: %w", err)
+	}
+	var creds credentials.TransportCredentials
+	switch u.Scheme {
+	case "grpc":
+		if token != "" {
+			return nil, fmt.Errorf("reapi token is sent only over TLS, use grpcs:// target: %s", target)
+		}
+		creds = insecure.NewCredentials()
+	case "grpcs":
+		creds = credentials.NewTLS(&tls.Config{})
+	default:
+		return nil, fmt.Errorf("invalid reapi target scheme: %s", target)
+	}
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+	return grpc.NewClient(u.Host, options...)
+}
+
+func (t bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity keeps gRPC from sending the token in plaintext
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// ping checks that the server is reachable with the credentials by looking up an absent action
+func (r *reapiStorage) ping(ctx context.Context) error {
+	_, _, err := r.getResult(ctx, strings.Repeat("0", 64))
+	return err
+}
+
+func (r *reapiStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return GetResponse{}, false, fmt.Errorf("empty key")
+	}
+	result, ok, err := r.getResult(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, false, err
+	}
+	outputID, digest, ok := parseActionResult(result)
+	if !ok {
+		//stored by something else than gocacheprog
+		return GetResponse{}, false, nil
+	}
+	sum, err := hex.DecodeString(digest.Hash)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("reapi digest error: %w %s", err, key)
+	}
+	var body io.ReadCloser
+	if digest.SizeBytes <= r.batchLimit {
+		body, ok, err = r.batchRead(ctx, digest)
+	} else {
+		body, ok, err = r.streamRead(ctx, digest)
+	}
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("reapi cas read error: %w %s", err, key)
+	}
+	if !ok {
+		//blob was evicted
+		return GetResponse{}, false, nil
+	}
+	stream := &streamBody{storage: "reapi", key: key, body: body}
+	if r.verify {
+		stream.hash, stream.expected = newContentHash(), sum
+	}
+	return GetResponse{OutputID: outputID, BodySize: digest.SizeBytes, Body: stream}, true, nil
+}
+
+// getResult returns action result of key, false if it is absent
+func (r *reapiStorage) getResult(ctx context.Context, key string) (*repb.ActionResult, bool, error) {
+	result, err := r.ac.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName: r.instance,
+		ActionDigest: actionDigest(key),
+	})
+	if status.Code(err) == codes.NotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("reapi get action result error: %w %s", err, key)
+	}
+	return result, true, nil
+}
+
+func (r *reapiStorage) batchRead(ctx context.Context, digest *repb.Digest) (io.ReadCloser, bool, error) {
+	resp, err := r.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+		InstanceName: r.instance,
+		Digests:      []*repb.Digest{digest},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(resp.Responses) != 1 {
+		return nil, false, fmt.Errorf("expected 1 blob, got %d", len(resp.Responses))
+	}
+	blob := resp.Responses[0]
+	if code := codes.Code(blob.GetStatus().GetCode()); code == codes.NotFound {
+		return nil, false, nil
+	} else if code != codes.OK {
+		return nil, false, status.ErrorProto(blob.GetStatus())
+	}
+	return io.NopCloser(bytes.NewReader(blob.Data)), true, nil
+}
+
+func (r *reapiStorage) streamRead(ctx context.Context, digest *repb.Digest) (io.ReadCloser, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := r.byteStream.Read(ctx, &bytestream.ReadRequest{ResourceName: r.readResource(digest)})
+	if err != nil {
+		cancel()
+		return nil, false, err
+	}
+	//the first message tells whether the blob exists
+	first, err := stream.Recv()
+	if status.Code(err) == codes.NotFound {
+		cancel()
+		return nil, false, nil
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		cancel()
+		return nil, false, err
+	}
+	return &byteStreamReader{stream: stream, buf: first.GetData(), err: err, cancel: cancel}, true, nil
+}
+
+func (r *reapiStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	b, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("reapi bodyReadAll error: %w %s", err, request.Key)
+	}
+	digest := &repb.Digest{Hash: hex.EncodeToString(contentHash(b)), SizeBytes: int64(len(b))}
+	missing, err := r.isMissing(ctx, digest)
+	if err != nil {
+		return "", fmt.Errorf("reapi find missing blobs error: %w %s", err, request.Key)
+	}
+	if !missing {
+		reapiUploadSkips.Add(1)
+		reapiUploadBytesSaved.Add(digest.SizeBytes)
+	} else if digest.SizeBytes <= r.batchLimit {
+		err = r.batchUpdate(ctx, digest, b)
+	} else {
+		err = r.streamWrite(ctx, digest, b)
+	}
+	if err != nil {
+		return "", fmt.Errorf("reapi cas write error: %w %s", err, request.Key)
+	}
+	result, err := newActionResult(request.OutputID, digest)
+	if err != nil {
+		return "", fmt.Errorf("reapi action result error: %w %s", err, request.Key)
+	}
+	_, err = r.ac.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: r.instance,
+		ActionDigest: actionDigest(request.Key),
+		ActionResult: result,
+	})
+	if err != nil {
+		return "", fmt.Errorf("reapi update action result error: %w %s", err, request.Key)
+	}
+	//no disk path to return
+	return "", nil
+}
+
+func (r *reapiStorage) isMissing(ctx context.Context, digest *repb.Digest) (bool, error) {
+	resp, err := r.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+		InstanceName: r.instance,
+		BlobDigests:  []*repb.Digest{digest},
+	})
+	if err != nil {
+		return false, err
+	}
+	return len(resp.MissingBlobDigests) != 0, nil
+}
+
+func (r *reapiStorage) batchUpdate(ctx context.Context, digest *repb.Digest, b []byte) error {
+	resp, err := r.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+		InstanceName: r.instance,
+		Requests:     []*repb.BatchUpdateBlobsRequest_Request{{Digest: digest, Data: b}},
+	})
+	if err != nil {
+		return err
+	}
+	for _, blob := range resp.Responses {
+		if codes.Code(blob.GetStatus().GetCode()) != codes.OK {
+			return status.ErrorProto(blob.GetStatus())
+		}
+	}
+	return nil
+}
+
+func (r *reapiStorage) streamWrite(ctx context.Context, digest *repb.Digest, b []byte) error {
+	resource, err := r.writeResource(digest)
+	if err != nil {
+		return err
+	}
+	stream, err := r.byteStream.Write(ctx)
+	if err != nil {
+		return err
+	}
+	for offset := 0; offset < len(b); offset += reapiChunkSize {
+		end := min(offset+reapiChunkSize, len(b))
+		err = stream.Send(&bytestream.WriteRequest{
+			ResourceName: resource,
+			WriteOffset:  int64(offset),
+			FinishWrite:  end == len(b),
+			Data:         b[offset:end],
+		})
+		if errors.Is(err, io.EOF) {
+			//server ends the stream early if the blob already exists, the status is returned by CloseAndRecv
+			break
+		}
+		if err != nil {
+			return err
+		}
+		//resource name is only required in the first request
+		resource = ""
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	if resp.CommittedSize != digest.SizeBytes && resp.CommittedSize != -1 {
+		return fmt.Errorf("committed %d bytes of %d", resp.CommittedSize, digest.SizeBytes)
+	}
+	return nil
+}
+
+func (r *reapiStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	result, ok, err := r.getResult(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	storedOutputID, digest, ok := parseActionResult(result)
+	if !ok || !bytes.Equal(storedOutputID, outputID) {
+		return false, nil
+	}
+	missing, err := r.isMissing(ctx, digest)
+	if err != nil {
+		return false, fmt.Errorf("reapi find missing blobs error: %w %s", err, key)
+	}
+	return !missing, nil
+}
+
+func (r *reapiStorage) Close(_ context.Context) error {
+	return r.closeClient()
+}
+
+func (r *reapiStorage) readResource(digest *repb.Digest) string {
+	return path.Join(r.instance, "blobs", digest.Hash, strconv.FormatInt(digest.SizeBytes, 10))
+}
+
+func (r *reapiStorage) writeResource(digest *repb.Digest) (string, error) {
+	u := make([]byte, 16)
+	_, err := rand.Read(u)
+	if err != nil {
+		return "", err
+	}
+	//version 4 UUID
+	u[6], u[8] = u[6]&0x0f|0x40, u[8]&0x3f|0x80
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+	return path.Join(r.instance, "uploads", uuid, "blobs", digest.Hash, strconv.FormatInt(digest.SizeBytes, 10)), nil
+}
+
+// actionDigest addresses ActionID in the action cache, size is the one of ActionID
+// as there is no Action message behind it
+func actionDigest(key string) *repb.Digest {
+	return &repb.Digest{Hash: actionHash(key), SizeBytes: 32}
+}
+
+// newActionResult records body as the only output file and OutputID in auxiliary metadata
+func newActionResult(outputID []byte, digest *repb.Digest) (*repb.ActionResult, error) {
+	aux, err := anypb.New(wrapperspb.Bytes(outputID))
+	if err != nil {
+		return nil, err
+	}
+	return &repb.ActionResult{
+		OutputFiles: []*repb.OutputFile{{Path: reapiOutputPath, Digest: digest}},
+		ExecutionMetadata: &repb.ExecutedActionMetadata{
+			Worker:            reapiWorker,
+			AuxiliaryMetadata: []*anypb.Any{aux},
+		},
+	}, nil
+}
+
+// parseActionResult returns OutputID and body digest of result written by newActionResult
+func parseActionResult(result *repb.ActionResult) ([]byte, *repb.Digest, bool) {
+	if len(result.OutputFiles) != 1 || result.OutputFiles[0].GetDigest() == nil {
+		return nil, nil, false
+	}
+	for _, aux := range result.GetExecutionMetadata().GetAuxiliaryMetadata() {
+		var outputID wrapperspb.BytesValue
+		if aux.UnmarshalTo(&outputID) == nil {
+			return outputID.Value, result.OutputFiles[0].Digest, true
+		}
+	}
+	return nil, nil, false
+}
+
+// byteStreamReader reads data of ByteStream read responses, Close cancels the stream
+type byteStreamReader struct {
+	stream bytestream.ByteStream_ReadClient
+	buf    []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func (b *byteStreamReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 && b.err == nil {
+		var resp *bytestream.ReadResponse
+		resp, b.err = b.stream.Recv()
+		b.buf = resp.GetData()
+	}
+	if len(b.buf) == 0 {
+		return 0, b.err
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *byteStreamReader) Close() error {
+	b.cancel()
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func Test_REAPIStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Run("small body goes through batch calls", func(t *testing.T) {
+		fake, conn := newFakeREAPI(t, "")
+		storage := NewREAPIStorage(conn, REAPIOptions{InstanceName: "main", BatchLimit: 100, Verify: true})
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if string(get.OutputID) != "OutputID_1" || string(must(io.ReadAll(get.Body))) != "hello" {
+			t.Fatal("expected stored entry")
+		}
+		if fake.streams.Load() != 0 {
+			t.Fatal("expected no ByteStream calls")
+		}
+		has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		_, ok, err = storage.Get(ctx, "ActionID_2")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("large body goes through ByteStream", func(t *testing.T) {
+		fake, conn := newFakeREAPI(t, "")
+		storage := NewREAPIStorage(conn, REAPIOptions{BatchLimit: 100})
+		body := strings.Repeat("hello", reapiChunkSize/2)
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if string(must(io.ReadAll(get.Body))) != body {
+			t.Fatal("expected stored body")
+		}
+		if fake.streams.Load() != 2 {
+			t.Fatalf("expected ByteStream write and read, got %d", fake.streams.Load())
+		}
+	})
+	t.Run("body shared by actions is uploaded once", func(t *testing.T) {
+		fake, conn := newFakeREAPI(t, "")
+		storage := NewREAPIStorage(conn, REAPIOptions{})
+		for _, key := range []string{"ActionID_1", "ActionID_2"} {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if fake.uploads.Load() != 1 {
+			t.Fatalf("expected one upload, got %d", fake.uploads.Load())
+		}
+	})
+	t.Run("evicted blob is a miss", func(t *testing.T) {
+		fake, conn := newFakeREAPI(t, "")
+		storage := NewREAPIStorage(conn, REAPIOptions{})
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.blobs = map[string][]byte{}
+		has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+		if err != nil || has {
+			t.Fatal("expected not to have entry", err)
+		}
+		_, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("token is sent", func(t *testing.T) {
+		fake, conn := newFakeREAPI(t, "secret")
+		storage := NewREAPIStorage(conn, REAPIOptions{})
+		if err := storage.(*reapiStorage).ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if fake.authorization != "Bearer secret" {
+			t.Fatalf("unexpected authorization %q", fake.authorization)
+		}
+	})
+	t.Run("token is not sent in plaintext", func(t *testing.T) {
+		if _, err := dialREAPI("grpc://localhost:8980", "secret"); err == nil {
+			t.Fatal("expected error")
+		}
+		if conn, err := dialREAPI("grpcs://localhost:8980", "secret"); err != nil {
+			t.Fatal(err)
+		} else {
+			conn.Close()
+		}
+	})
+}
+
+type (
+	// fakeREAPI keeps action cache and CAS in memory
+	fakeREAPI struct {
+		mu            sync.Mutex
+		results       map[string]*repb.ActionResult
+		blobs         map[string][]byte
+		uploads       atomic.Int64
+		streams       atomic.Int64
+		authorization string
+	}
+	fakeActionCache struct {
+		repb.UnimplementedActionCacheServer
+		*fakeREAPI
+	}
+	fakeCAS struct {
+		repb.UnimplementedContentAddressableStorageServer
+		*fakeREAPI
+	}
+	fakeByteStream struct {
+		*bytestream.UnimplementedByteStreamServer
+		*fakeREAPI
+	}
+)
+
+// newFakeREAPI serves fake over an in-memory listener, with TLS if token is set, as it requires
+func newFakeREAPI(t *testing.T, token string) (*fakeREAPI, *grpc.ClientConn) {
+	fake := &fakeREAPI{results: map[string]*repb.ActionResult{}, blobs: map[string][]byte{}}
+	listener := bufconn.Listen(1024 * 1024)
+	serverCreds, clientCreds := insecure.NewCredentials(), insecure.NewCredentials()
+	options := []grpc.DialOption{grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) })}
+	if token != "" {
+		//borrows the test certificate of httptest
+		tlsServer := httptest.NewTLSServer(nil)
+		tlsServer.Close()
+		roots := x509.NewCertPool()
+		roots.AddCert(tlsServer.Certificate())
+		serverCreds = credentials.NewServerTLSFromCert(&tlsServer.TLS.Certificates[0])
+		clientCreds = credentials.NewTLS(&tls.Config{RootCAs: roots, ServerName: "example.com"})
+		options = append(options, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+	server := grpc.NewServer(grpc.Creds(serverCreds))
+	repb.RegisterActionCacheServer(server, fakeActionCache{fakeREAPI: fake})
+	repb.RegisterContentAddressableStorageServer(server, fakeCAS{fakeREAPI: fake})
+	bytestream.RegisterByteStreamServer(server, fakeByteStream{fakeREAPI: fake})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	options = append(options, grpc.WithTransportCredentials(clientCreds))
+	conn := must(grpc.NewClient("passthrough:///bufconn", options...))
+	t.Cleanup(func() { conn.Close() })
+	return fake, conn
+}
+
+func (f fakeActionCache) GetActionResult(ctx context.Context, request *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("authorization")) > 0 {
+		f.authorization = md.Get("authorization")[0]
+	}
+	result, ok := f.results[request.InstanceName+"/"+request.ActionDigest.Hash]
+	if !ok {
+		return nil, status.Error(codes.NotFound, "not found")
+	}
+	return result, nil
+}
+
+func (f fakeActionCache) UpdateActionResult(_ context.Context, request *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[request.InstanceName+"/"+request.ActionDigest.Hash] = proto.Clone(request.ActionResult).(*repb.ActionResult)
+	return request.ActionResult, nil
+}
+
+func (f fakeCAS) FindMissingBlobs(_ context.Context, request *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range request.BlobDigests {
+		if _, ok := f.blobs[digest.Hash]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+func (f fakeCAS) BatchUpdateBlobs(_ context.Context, request *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, blob := range request.Requests {
+		f.uploads.Add(1)
+		f.blobs[blob.Digest.Hash] = blob.Data
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: blob.Digest, Status: status.New(codes.OK, "").Proto()})
+	}
+	return resp, nil
+}
+
+func (f fakeCAS) BatchReadBlobs(_ context.Context, request *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, digest := range request.Digests {
+		b, ok := f.blobs[digest.Hash]
+		code := codes.OK
+		if !ok {
+			code = codes.NotFound
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchReadBlobsResponse_Response{Digest: digest, Data: b, Status: status.New(code, "").Proto()})
+	}
+	return resp, nil
+}
+
+func (f fakeByteStream) Read(request *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	f.streams.Add(1)
+	parts := strings.Split(request.ResourceName, "/")
+	f.mu.Lock()
+	b, ok := f.blobs[parts[len(parts)-2]]
+	f.mu.Unlock()
+	if !ok {
+		return status.Error(codes.NotFound, "not found")
+	}
+	for len(b) > 0 {
+		n := min(len(b), 1000)
+		err := stream.Send(&bytestream.ReadResponse{Data: b[:n]})
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func (f fakeByteStream) Write(stream bytestream.ByteStream_WriteServer) error {
+	f.streams.Add(1)
+	var resource string
+	var body bytes.Buffer
+	for {
+		request, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return status.Error(codes.InvalidArgument, "write is not finished")
+		}
+		if err != nil {
+			return err
+		}
+		if resource == "" {
+			resource = request.ResourceName
+		}
+		if request.WriteOffset != int64(body.Len()) {
+			return status.Error(codes.InvalidArgument, "unexpected offset")
+		}
+		body.Write(request.Data)
+		if request.FinishWrite {
+			break
+		}
+	}
+	parts := strings.Split(resource, "/")
+	f.mu.Lock()
+	f.uploads.Add(1)
+	f.blobs[parts[len(parts)-2]] = body.Bytes()
+	f.mu.Unlock()
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(body.Len())})
+}
@@ -3,30 +3,100 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// expiration is default TTL of entries, reads and writes of an entry prolong it
+const expiration = time.Hour * 24 * 7
+
+var (
+	redisUploadSkips      = expvar.NewInt("redis_upload_skips")
+	redisUploadBytesSaved = expvar.NewInt("redis_upload_bytes_saved")
+	redisPromoted         = expvar.NewInt("redis_promoted")
+)
+
 type (
+	// redisStorage keeps small ActionID meta records and blobs addressed by content hash,
+	// so a body is uploaded once for all actions storing it
 	redisStorage struct {
-		cluster        redis.UniversalClient
-		redisKeyPrefix string
+		cluster   redis.UniversalClient
+		readRoots []string
+		writeRoot string
+		verify    bool
+		promote   bool
+		keepTTL   bool
+		ttl       time.Duration
+	}
+	RedisOptions struct {
+		//KeyPrefix namespaces keys
+		KeyPrefix string
+		//WritePrefix namespaces written keys instead of KeyPrefix, if set
+		WritePrefix string
+		//ReadPrefixes are namespaces looked up in order instead of KeyPrefix, if set
+		ReadPrefixes []string
+		//Promote copies entries found in a read namespace other than the written one to the written one
+		Promote bool
+		//Verify enables checking body hash on download
+		Verify bool
+		//Namespace separates keys of different toolchains, see detectToolchain
+		Namespace string
+		//Epoch is generation of keyspace, see loadEpoch
+		Epoch int64
+		//TTL of entries, expiration if 0
+		TTL time.Duration
+		//KeepTTL leaves TTL of read entries as is, so read-only builds do not write to redis
+		KeepTTL bool
 	}
 	meta struct {
 		OutputID []byte
 		Size     int64
+		Sum      []byte `json:",omitempty"`
 	}
 )
 
-func NewRedisStorage(cluster redis.UniversalClient, redisKeyPrefix string) Storage {
-	return &redisStorage{cluster: cluster, redisKeyPrefix: strings.TrimSpace(redisKeyPrefix)}
+func NewRedisStorage(cluster redis.UniversalClient, options RedisOptions) Storage {
+	readRoots, writeRoot := options.roots()
+	r := &redisStorage{
+		cluster:   cluster,
+		readRoots: readRoots,
+		writeRoot: writeRoot,
+		verify:    options.Verify,
+		promote:   options.Promote,
+		keepTTL:   options.KeepTTL,
+		ttl:       options.TTL,
+	}
+	if r.ttl <= 0 {
+		r.ttl = expiration
+	}
+	return r
+}
+
+// roots returns roots of keyspaces read in order and written
+func (o RedisOptions) roots() ([]string, string) {
+	writePrefix := o.KeyPrefix
+	if strings.TrimSpace(o.WritePrefix) != "" {
+		writePrefix = o.WritePrefix
+	}
+	readRoots := []string{keyRoot(o.KeyPrefix, o.Namespace, o.Epoch)}
+	if len(o.ReadPrefixes) > 0 {
+		readRoots = nil
+		for _, prefix := range o.ReadPrefixes {
+			readRoots = append(readRoots, keyRoot(prefix, o.Namespace, o.Epoch))
+		}
+	}
+	return readRoots, keyRoot(writePrefix, o.Namespace, o.Epoch)
 }
 
 func (r redisStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
@@ -50,17 +120,47 @@ func (r redisStorage) get(ctx context.Context, key string) (io.Reader, meta, boo
 	if strings.TrimSpace(key) == "" {
 		return nil, meta{}, false, fmt.Errorf("empty key")
 	}
-	keyBody, keyMeta := r.keyNames(key)
-	bodyGet := r.cluster.Get(ctx, keyBody)
-	err := bodyGet.Err()
-	if errors.Is(err, redis.Nil) {
-		return nil, meta{}, false, nil
+	for _, root := range r.readRoots {
+		body, m, ok, err := r.getFrom(ctx, root, key)
+		if err != nil {
+			return nil, meta{}, false, err
+		}
+		if !ok {
+			continue
+		}
+		if r.promote && root != r.writeRoot {
+			r.copyTo(ctx, r.writeRoot, key, m, body)
+		}
+		return bytes.NewReader(body), m, true, nil
 	}
+	return nil, meta{}, false, nil
+}
+
+// copyTo stores entry in another namespace, failures are only logged
+func (r redisStorage) copyTo(ctx context.Context, root, key string, m meta, body []byte) {
+	//body may come from a blob of an older version, addressed otherwise
+	m.Sum = contentHash(body)
+	metaBytes, err := json.Marshal(m)
 	if err != nil {
-		return nil, meta{}, false, fmt.Errorf("redis bodyGet error: %w %s", err, key)
+		fmt.Fprintf(os.Stderr, "redis promote error: %s %s\n", err, key)
+		return
 	}
-	metaGet := r.cluster.Get(ctx, keyMeta)
-	err = metaGet.Err()
+	_, err = r.cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sumBlobKey(root, m.Sum), body, r.ttlOf(key))
+		pipe.Set(ctx, metaKey(root, key), metaBytes, r.ttlOf(key))
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "redis promote error: %s %s\n", err, key)
+		return
+	}
+	redisPromoted.Add(1)
+}
+
+// getFrom looks up entry in the namespace of root
+func (r redisStorage) getFrom(ctx context.Context, root, key string) ([]byte, meta, bool, error) {
+	metaGet := r.cluster.Get(ctx, metaKey(root, key))
+	err := metaGet.Err()
 	if errors.Is(err, redis.Nil) {
 		return nil, meta{}, false, nil
 	}
@@ -76,31 +176,96 @@ func (r redisStorage) get(ctx context.Context, key string) (io.Reader, meta, boo
 	if err != nil {
 		return nil, meta{}, false, fmt.Errorf("redis metaGet Unmarshal error: %w %s", err, key)
 	}
+	//blobs of older versions are addressed by OutputID or stored under ActionID
+	blobKeys := []string{blobKey(root, key, m.OutputID), legacyBodyKey(root, key)}
+	if len(m.Sum) != 0 {
+		blobKeys = append([]string{sumBlobKey(root, m.Sum)}, blobKeys...)
+	}
+	var bodyGet *redis.StringCmd
+	var keyBlob string
+	for _, keyBlob = range blobKeys {
+		if r.keepTTL {
+			bodyGet = r.cluster.Get(ctx, keyBlob)
+		} else {
+			//referencing blob prolongs its life
+			bodyGet = r.cluster.GetEx(ctx, keyBlob, r.ttlOf(key))
+		}
+		err = bodyGet.Err()
+		if !errors.Is(err, redis.Nil) {
+			break
+		}
+	}
+	if errors.Is(err, redis.Nil) {
+		return nil, meta{}, false, nil
+	}
+	if err != nil {
+		return nil, meta{}, false, fmt.Errorf("redis bodyGet error: %w %s", err, key)
+	}
 	b, err := bodyGet.Bytes()
 	if err != nil {
 		return nil, meta{}, false, fmt.Errorf("redis bodyGet Bytes error: %w %s", err, key)
 	}
-	return bytes.NewReader(b), m, true, nil
+	if r.verify {
+		ok, err := verifySum(bytes.NewReader(b), m.Sum, m.OutputID)
+		if err != nil {
+			return nil, meta{}, false, fmt.Errorf("redis verify error: %w %s", err, key)
+		}
+		if !ok {
+			//blobs addressed by OutputID may be shared with entries of other bytes, only the entry goes
+			if keyBlob == blobKey(root, key, m.OutputID) && len(m.OutputID) != 0 {
+				keyBlob = ""
+			}
+			r.quarantine(ctx, root, key, keyBlob, b)
+			reportCorrupted("redis", key)
+			return nil, meta{}, false, nil
+		}
+	}
+	return b, m, true, nil
+}
+
+// quarantine keeps corrupted body for inspection for a day and deletes the entry
+func (r redisStorage) quarantine(ctx context.Context, root, key, keyBlob string, body []byte) {
+	_, err := r.cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, path.Join(root, "corrupted", key), body, time.Hour*24)
+		pipe.Del(ctx, metaKey(root, key))
+		//a corrupted content addressed blob is corrupted for every action referencing it
+		if keyBlob != "" {
+			pipe.Del(ctx, keyBlob)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "redis quarantine error: %s %s\n", err, key)
+	}
 }
 
 func (r redisStorage) Put(ctx context.Context, request PutRequest) (string, error) {
-	const expiration = time.Hour * 24 * 7
-	keyBody, keyMeta := r.keyNames(request.Key)
 	b, err := io.ReadAll(request.Body)
 	if err != nil {
 		return "", fmt.Errorf("redis bodyReadAll error: %w %s", err, request.Key)
 	}
-	set := r.cluster.Set(ctx, keyBody, b, expiration)
-	err = set.Err()
+	//blob is addressed by its content, so it is shared only by actions storing the same bytes,
+	//bodies of the same output differ once encrypted or compressed with another dictionary
+	sum := contentHash(b)
+	keyBlob := sumBlobKey(r.writeRoot, sum)
+	exists, err := r.expire(ctx, r.cluster, keyBlob, request.Key).Result()
 	if err != nil {
-		return "", fmt.Errorf("redis set error: %w %s", err, request.Key)
+		return "", fmt.Errorf("redis expire error: %w %s", err, request.Key)
 	}
-	metaBytes, err := json.Marshal(meta{OutputID: request.OutputID, Size: request.BodySize})
+	if exists {
+		redisUploadSkips.Add(1)
+		redisUploadBytesSaved.Add(request.BodySize)
+	} else {
+		err = r.cluster.Set(ctx, keyBlob, b, r.ttlOf(request.Key)).Err()
+		if err != nil {
+			return "", fmt.Errorf("redis set error: %w %s", err, request.Key)
+		}
+	}
+	metaBytes, err := json.Marshal(meta{OutputID: request.OutputID, Size: request.BodySize, Sum: sum})
 	if err != nil {
 		return "", fmt.Errorf("redis metaMarshal error: %w %s", err, request.Key)
 	}
-	set = r.cluster.Set(ctx, keyMeta, metaBytes, expiration)
-	err = set.Err()
+	err = r.cluster.Set(ctx, metaKey(r.writeRoot, request.Key), metaBytes, r.ttlOf(request.Key)).Err()
 	if err != nil {
 		return "", fmt.Errorf("redis set error: %w %s", err, request.Key)
 	}
@@ -108,18 +273,125 @@ func (r redisStorage) Put(ctx context.Context, request PutRequest) (string, erro
 	return "", nil
 }
 
+// Has checks written keys, as it tells whether put is needed
+func (r redisStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	var metaGet *redis.StringCmd
+	_, err := r.cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		metaGet = pipe.Get(ctx, metaKey(r.writeRoot, key))
+		if !r.keepTTL {
+			r.expire(ctx, pipe, metaKey(r.writeRoot, key), key)
+		}
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("redis has error: %w %s", err, key)
+	}
+	var m meta
+	err = json.Unmarshal([]byte(metaGet.Val()), &m)
+	if err != nil {
+		return false, fmt.Errorf("redis metaGet Unmarshal error: %w %s", err, key)
+	}
+	if !bytes.Equal(m.OutputID, outputID) {
+		return false, nil
+	}
+	//the blob is known only from meta
+	keyBlob := storedBlobKey(r.writeRoot, key, m)
+	var blobExists *redis.IntCmd
+	_, err = r.cluster.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		blobExists = pipe.Exists(ctx, keyBlob)
+		if !r.keepTTL {
+			r.expire(ctx, pipe, keyBlob, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("redis has error: %w %s", err, key)
+	}
+	return blobExists.Val() == 1, nil
+}
+
+// ttlOf returns TTL of keys of entry key, 0 means none
+func (r redisStorage) ttlOf(key string) time.Duration {
+	if isDictKey(key) {
+		return 0
+	}
+	return r.ttl
+}
+
+// expire refreshes TTL of k belonging to entry key, returns false if k is absent
+// or, for entries without TTL, if it has none
+func (r redisStorage) expire(ctx context.Context, c redis.Cmdable, k, key string) *redis.BoolCmd {
+	if ttl := r.ttlOf(key); ttl != 0 {
+		return c.Expire(ctx, k, ttl)
+	}
+	return c.Persist(ctx, k)
+}
+
 func (r redisStorage) Close(_ context.Context) error {
 	return r.cluster.Close()
 }
 
-func (r redisStorage) keyNames(key string) (keyBody, keyMeta string) {
+// epochKey holds generation of keyspace, bumping it makes every runner switch to a clean keyspace
+const epochKey = "gocacheprog/epoch"
+
+// loadEpoch returns current generation of keyspace, 0 if it was never bumped
+func loadEpoch(ctx context.Context, cluster redis.UniversalClient) (int64, error) {
+	epoch, err := cluster.Get(ctx, epochKey).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+// bumpEpoch atomically switches to the next generation of keyspace
+func bumpEpoch(ctx context.Context, cluster redis.UniversalClient) (int64, error) {
+	return cluster.Incr(ctx, epochKey).Result()
+}
+
+func keyRoot(prefix, namespace string, epoch int64) string {
 	parts := []string{"gocacheprog"}
-	if r.redisKeyPrefix != "" {
-		parts = append(parts, r.redisKeyPrefix)
-	}
-	parts = append(parts, key)
-	key = path.Join(parts...)
-	keyBody = key + "-o"
-	keyMeta = key + "-i"
-	return keyBody, keyMeta
+	if prefix = strings.TrimSpace(prefix); prefix != "" {
+		parts = append(parts, prefix)
+	}
+	if namespace != "" {
+		parts = append(parts, namespace)
+	}
+	//keys of the initial generation stay as they were before epochs
+	if epoch != 0 {
+		parts = append(parts, "e"+strconv.FormatInt(epoch, 10))
+	}
+	return path.Join(parts...)
+}
+
+// metaKey is a small record of ActionID pointing to the blob
+func metaKey(root, key string) string {
+	return path.Join(root, key) + "-i"
+}
+
+// blobKey addresses body by OutputID, falls back to the ActionID if OutputID is absent
+func blobKey(root, key string, outputID []byte) string {
+	if len(outputID) == 0 {
+		return legacyBodyKey(root, key)
+	}
+	return path.Join(root, "o", hex.EncodeToString(outputID))
+}
+
+// sumBlobKey addresses body by the content hash of the stored bytes
+func sumBlobKey(root string, sum []byte) string {
+	return path.Join(root, "s", hex.EncodeToString(sum))
+}
+
+// storedBlobKey is the key of the blob meta points to, entries of older versions have no sum
+func storedBlobKey(root, key string, m meta) string {
+	if len(m.Sum) == 0 {
+		return blobKey(root, key, m.OutputID)
+	}
+	return sumBlobKey(root, m.Sum)
+}
+
+func legacyBodyKey(root, key string) string {
+	return path.Join(root, key) + "-o"
 }
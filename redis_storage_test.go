@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RedisStorage(t *testing.T) {
+	ctx := context.Background()
+	outputID := contentHash([]byte("hello"))
+	put := func(t *testing.T, storage Storage, key string) {
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(t *testing.T, storage Storage, key string) bool {
+		resp, ok, err := storage.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok && string(must(io.ReadAll(resp.Body))) != "hello" {
+			t.Fatal("expected stored body")
+		}
+		return ok
+	}
+	t.Run("read-only reads keep TTL", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		put(t, NewRedisStorage(client, RedisOptions{TTL: time.Hour}), "ActionID_1")
+		server.FastForward(30 * time.Minute)
+		storage := NewRedisStorage(client, RedisOptions{TTL: time.Hour, KeepTTL: true})
+		if !get(t, storage, "ActionID_1") {
+			t.Fatal("expected to be found")
+		}
+		if has, err := storage.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		for _, key := range []string{metaKey("gocacheprog", "ActionID_1"), sumBlobKey("gocacheprog", outputID)} {
+			if ttl := server.TTL(key); ttl != 30*time.Minute {
+				t.Fatalf("expected TTL of %s to be kept, got %s", key, ttl)
+			}
+		}
+	})
+	t.Run("outputs stored with different bytes keep their own blobs", func(t *testing.T) {
+		_, client := newTestRedis(t)
+		storage := NewRedisStorage(client, RedisOptions{Verify: true})
+		//encrypted or differently compressed bodies of the same output
+		bodies := map[string]string{"ActionID_1": "hello", "ActionID_2": "HELLO"}
+		for _, key := range []string{"ActionID_1", "ActionID_2"} {
+			_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: outputID, Body: strings.NewReader(bodies[key]), BodySize: 5})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for key, body := range bodies {
+			resp, ok, err := storage.Get(ctx, key)
+			if err != nil || !ok || string(must(io.ReadAll(resp.Body))) != body {
+				t.Fatalf("expected body of %s, %v", key, err)
+			}
+		}
+	})
+	t.Run("dictionaries are kept without TTL", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		storage := NewRedisStorage(client, RedisOptions{TTL: time.Hour})
+		d := trainTestDict(t)
+		id := must(publishDict(ctx, storage, d))
+		server.FastForward(2 * time.Hour)
+		for range 2 {
+			if _, err := loadDict(ctx, storage, id); err != nil {
+				t.Fatal(err)
+			}
+			if has, err := storage.Has(ctx, dictKey(id), contentHash(d)); err != nil || !has {
+				t.Fatal("expected to have dictionary", err)
+			}
+		}
+		if latest, err := loadLatestDictID(ctx, storage); err != nil || latest != id {
+			t.Fatal("expected latest dictionary", latest, err)
+		}
+		for _, key := range server.Keys() {
+			if ttl := server.TTL(key); ttl != 0 {
+				t.Fatalf("expected no TTL of %s, got %s", key, ttl)
+			}
+		}
+	})
+	t.Run("entries of older layouts are read", func(t *testing.T) {
+		_, client := newTestRedis(t)
+		storage := NewRedisStorage(client, RedisOptions{Verify: true})
+		store := func(keyBlob string) {
+			must0(client.Set(ctx, metaKey("gocacheprog", "ActionID_1"), must(json.Marshal(meta{OutputID: outputID, Size: 5})), 0).Err())
+			must0(client.Set(ctx, keyBlob, "hello", 0).Err())
+		}
+		store(legacyBodyKey("gocacheprog", "ActionID_1"))
+		if !get(t, storage, "ActionID_1") {
+			t.Fatal("expected body stored under ActionID to be found")
+		}
+		//such bodies are uploaded again in the current layout
+		if has, err := storage.Has(ctx, "ActionID_1", outputID); err != nil || has {
+			t.Fatal("expected legacy entry to be put again", err)
+		}
+		store(blobKey("gocacheprog", "ActionID_1", outputID))
+		if !get(t, storage, "ActionID_1") {
+			t.Fatal("expected blob addressed by OutputID to be found")
+		}
+		if has, err := storage.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+	})
+	t.Run("corrupted blob shared by OutputID is kept", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		storage := NewRedisStorage(client, RedisOptions{Verify: true})
+		keyBlob := blobKey("gocacheprog", "ActionID_1", outputID)
+		must0(client.Set(ctx, metaKey("gocacheprog", "ActionID_1"), must(json.Marshal(meta{OutputID: outputID, Size: 5, Sum: contentHash([]byte("jello"))})), 0).Err())
+		must0(client.Set(ctx, keyBlob, "hello", 0).Err())
+		if get(t, storage, "ActionID_1") {
+			t.Fatal("expected miss")
+		}
+		if server.Exists(metaKey("gocacheprog", "ActionID_1")) || !server.Exists(keyBlob) {
+			t.Fatal("expected only the entry to be deleted")
+		}
+	})
+	t.Run("entry of a read prefix is promoted", func(t *testing.T) {
+		server, client := newTestRedis(t)
+		put(t, NewRedisStorage(client, RedisOptions{KeyPrefix: "main"}), "ActionID_1")
+		options := RedisOptions{ReadPrefixes: []string{"branch", "main"}, WritePrefix: "branch"}
+		if !get(t, NewRedisStorage(client, options), "ActionID_1") {
+			t.Fatal("expected to be found in main")
+		}
+		if server.Exists(metaKey("gocacheprog/branch", "ActionID_1")) {
+			t.Fatal("expected no promotion unless enabled")
+		}
+		options.Promote = true
+		if !get(t, NewRedisStorage(client, options), "ActionID_1") {
+			t.Fatal("expected to be found in main")
+		}
+		for _, key := range []string{metaKey("gocacheprog/branch", "ActionID_1"), sumBlobKey("gocacheprog/branch", outputID)} {
+			if !server.Exists(key) {
+				t.Fatal("expected entry to be promoted", key)
+			}
+		}
+		branch := NewRedisStorage(client, RedisOptions{KeyPrefix: "branch"})
+		if has, err := branch.Has(ctx, "ActionID_1", outputID); err != nil || !has {
+			t.Fatal("expected branch to have entry", err)
+		}
+	})
+	t.Run("bumped epoch switches to a clean keyspace", func(t *testing.T) {
+		_, client := newTestRedis(t)
+		epoch := must(loadEpoch(ctx, client))
+		if epoch != 0 {
+			t.Fatalf("expected initial epoch, got %d", epoch)
+		}
+		before := NewRedisStorage(client, RedisOptions{Epoch: epoch})
+		put(t, before, "ActionID_1")
+		epoch = must(bumpEpoch(ctx, client))
+		if loaded := must(loadEpoch(ctx, client)); loaded != epoch || epoch != 1 {
+			t.Fatalf("expected epoch 1, got %d and %d", epoch, loaded)
+		}
+		after := NewRedisStorage(client, RedisOptions{Epoch: epoch})
+		if get(t, after, "ActionID_1") {
+			t.Fatal("expected miss in the new keyspace")
+		}
+		put(t, after, "ActionID_1")
+		if !get(t, after, "ActionID_1") || !get(t, before, "ActionID_1") {
+			t.Fatal("expected entries of both keyspaces to be found")
+		}
+	})
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	s3DefaultPartSize    = 16 * 1024 * 1024
+	s3DefaultConcurrency = 8
+	s3MetaOutputID       = "X-Amz-Meta-Output-Id"
+	s3MetaSize           = "X-Amz-Meta-Size"
+	s3MetaSum            = "X-Amz-Meta-Sum"
+)
+
+var errS3Changed = errors.New("object changed during download")
+
+type (
+	// s3Storage keeps an object per ActionID with OutputID, size and hash in its metadata headers,
+	// large bodies are uploaded in parts and downloaded in parallel ranges
+	s3Storage struct {
+		client      *http.Client
+		signer      s3Signer
+		endpoint    *url.URL
+		bucket      string
+		prefix      string
+		partSize    int64
+		concurrency int
+		tempDir     string
+		verify      bool
+	}
+	S3Options struct {
+		//Endpoint is URL of the object store, buckets are addressed in path style
+		Endpoint string
+		Bucket   string
+		//Prefix namespaces keys
+		Prefix       string
+		Region       string
+		AccessKey    string
+		SecretKey    string
+		SessionToken string
+		//PartSize is size of parts of multipart uploads and ranged downloads, 16MB if 0
+		PartSize int64
+		//Concurrency limits parallel parts of one transfer, 8 if 0
+		Concurrency int
+		//TempDir receives large downloads, set it to the cache dir so they are moved rather than copied
+		TempDir string
+		//Verify enables checking body hash on download
+		Verify bool
+	}
+	s3Signer struct {
+		accessKey    string
+		secretKey    string
+		sessionToken string
+		region       string
+	}
+	s3Object struct {
+		outputID []byte
+		size     int64
+		sum      []byte
+		etag     string
+	}
+	s3InitiateMultipartUploadResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+	s3CompleteMultipartUpload struct {
+		XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletePart `xml:"Part"`
+	}
+	s3CompletePart struct {
+		PartNumber int
+		ETag       string
+	}
+)
+
+func NewS3Storage(client *http.Client, options S3Options) (Storage, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", options.Endpoint)
+	}
+	if options.Bucket == "" {
+		return nil, errors.New("empty s3 bucket")
+	}
+	s := &s3Storage{
+		client:      client,
+		signer:      s3Signer{accessKey: options.AccessKey, secretKey: options.SecretKey, sessionToken: options.SessionToken, region: options.Region},
+		endpoint:    endpoint,
+		bucket:      options.Bucket,
+		prefix:      strings.Trim(options.Prefix, "/"),
+		partSize:    options.PartSize,
+		concurrency: options.Concurrency,
+		tempDir:     options.TempDir,
+		verify:      options.Verify,
+	}
+	if s.partSize <= 0 {
+		s.partSize = s3DefaultPartSize
+	}
+	if s.concurrency <= 0 {
+		s.concurrency = s3DefaultConcurrency
+	}
+	if s.signer.region == "" {
+		s.signer.region = "us-east-1"
+	}
+	return s, nil
+}
+
+// ping checks that the bucket is reachable with the credentials
+func (s *s3Storage) ping(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 bucket %s: %s", s.bucket, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return GetResponse{}, false, fmt.Errorf("empty key")
+	}
+	obj, ok, err := s.head(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, false, err
+	}
+	var body io.ReadSeeker
+	if obj.size <= s.partSize {
+		body, err = s.download(ctx, key, obj)
+	} else {
+		body, err = s.downloadParallel(ctx, key, obj)
+	}
+	if errors.Is(err, errS3Changed) {
+		//overwritten by another runner, its entry is not the one described by the metadata
+		return GetResponse{}, false, nil
+	}
+	if err != nil {
+		return GetResponse{}, false, err
+	}
+	if s.verify {
+		ok, err := verifySum(body, obj.sum, obj.outputID)
+		if err == nil {
+			_, err = body.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			discardBody(body)
+			return GetResponse{}, false, fmt.Errorf("s3 verify error: %w %s", err, key)
+		}
+		if !ok {
+			discardBody(body)
+			s.delete(ctx, key)
+			reportCorrupted("s3", key)
+			return GetResponse{}, false, nil
+		}
+	}
+	return GetResponse{OutputID: obj.outputID, BodySize: obj.size, Body: body}, true, nil
+}
+
+// head returns metadata of the object, false if it is absent
+func (s *s3Storage) head(ctx context.Context, key string) (s3Object, bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return s3Object{}, false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return s3Object{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Object{}, false, fmt.Errorf("s3 head error: %s %s", resp.Status, key)
+	}
+	outputID, err := hex.DecodeString(resp.Header.Get(s3MetaOutputID))
+	if err != nil {
+		return s3Object{}, false, fmt.Errorf("s3 head output id error: %w %s", err, key)
+	}
+	sum, err := hex.DecodeString(resp.Header.Get(s3MetaSum))
+	if err != nil {
+		return s3Object{}, false, fmt.Errorf("s3 head sum error: %w %s", err, key)
+	}
+	size, err := strconv.ParseInt(resp.Header.Get(s3MetaSize), 10, 64)
+	if err != nil {
+		return s3Object{}, false, fmt.Errorf("s3 head size error: %w %s", err, key)
+	}
+	if size != resp.ContentLength {
+		//written by something else than gocacheprog
+		return s3Object{}, false, nil
+	}
+	return s3Object{outputID: outputID, size: size, sum: sum, etag: resp.Header.Get("ETag")}, true, nil
+}
+
+// download reads a small object into memory
+func (s *s3Storage) download(ctx context.Context, key string, obj s3Object) (io.ReadSeeker, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(key), nil, ifMatch(http.Header{}, obj.etag), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusNotFound {
+		return nil, errS3Changed
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 get error: %s %s", resp.Status, key)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("s3 get body error: %w %s", err, key)
+	}
+	if int64(len(b)) != obj.size {
+		return nil, errS3Changed
+	}
+	return bytes.NewReader(b), nil
+}
+
+// downloadParallel fetches ranges of a large object concurrently straight into a temporary file,
+// which the file system storage takes over
+func (s *s3Storage) downloadParallel(ctx context.Context, key string, obj s3Object) (io.ReadSeeker, error) {
+	f, err := os.CreateTemp(s.tempDir, "s3-*")
+	if err != nil {
+		return nil, fmt.Errorf("s3 temp file error: %w %s", err, key)
+	}
+	body := tempFileBody{File: f}
+	err = f.Truncate(obj.size)
+	if err == nil {
+		err = s.parallel(obj.size, func(offset, size int64) error {
+			return s.downloadRange(ctx, key, obj.etag, io.NewOffsetWriter(f, offset), offset, size)
+		})
+	}
+	if err != nil {
+		body.discard()
+		return nil, err
+	}
+	return body, nil
+}
+
+func (s *s3Storage) downloadRange(ctx context.Context, key, etag string, w io.Writer, offset, size int64) error {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)}}
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(key), nil, ifMatch(header, etag), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed || resp.StatusCode == http.StatusNotFound {
+		return errS3Changed
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("s3 get range error: %s %s", resp.Status, key)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return fmt.Errorf("s3 get range body error: %w %s", err, key)
+	}
+	if n != size {
+		return errS3Changed
+	}
+	return nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, request PutRequest) (string, error) {
+	b, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("s3 bodyReadAll error: %w %s", err, request.Key)
+	}
+	header := http.Header{
+		s3MetaOutputID: {hex.EncodeToString(request.OutputID)},
+		s3MetaSize:     {strconv.Itoa(len(b))},
+		s3MetaSum:      {hex.EncodeToString(contentHash(b))},
+	}
+	if int64(len(b)) <= s.partSize {
+		err = s.upload(ctx, request.Key, header, b)
+	} else {
+		err = s.uploadMultipart(ctx, request.Key, header, b)
+	}
+	//no disk path to return
+	return "", err
+}
+
+func (s *s3Storage) upload(ctx context.Context, key string, header http.Header, b []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), nil, header, b)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put error: %s %s", resp.Status, key)
+	}
+	return nil
+}
+
+func (s *s3Storage) uploadMultipart(ctx context.Context, key string, header http.Header, b []byte) error {
+	objectKey := s.objectKey(key)
+	resp, err := s.do(ctx, http.MethodPost, objectKey, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiate s3InitiateMultipartUploadResult
+	err = decodeS3Response(resp, &initiate)
+	if err != nil {
+		return fmt.Errorf("s3 create multipart upload error: %w %s", err, key)
+	}
+	uploadID := initiate.UploadID
+	complete := s3CompleteMultipartUpload{Parts: make([]s3CompletePart, (int64(len(b))+s.partSize-1)/s.partSize)}
+	err = s.parallel(int64(len(b)), func(offset, size int64) error {
+		number := int(offset/s.partSize) + 1
+		etag, err := s.uploadPart(ctx, objectKey, uploadID, number, b[offset:offset+size])
+		complete.Parts[number-1] = s3CompletePart{PartNumber: number, ETag: etag}
+		return err
+	})
+	if err == nil {
+		err = s.completeMultipart(ctx, objectKey, uploadID, complete)
+	}
+	if err != nil {
+		s.abortMultipart(ctx, objectKey, uploadID)
+		return fmt.Errorf("s3 multipart upload error: %w %s", err, key)
+	}
+	return nil
+}
+
+func (s *s3Storage) uploadPart(ctx context.Context, objectKey, uploadID string, number int, b []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, objectKey, query, nil, b)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("part %d: %s", number, resp.Status)
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Storage) completeMultipart(ctx context.Context, objectKey, uploadID string, complete s3CompleteMultipartUpload) error {
+	b, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPost, objectKey, url.Values{"uploadId": {uploadID}}, nil, b)
+	if err != nil {
+		return err
+	}
+	//errors of complete may come with 200 status, detected by root element of body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+	}
+	err = decodeS3Response(resp, &result)
+	if err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("complete: %s", result.Code)
+	}
+	return nil
+}
+
+// abortMultipart frees uploaded parts, failures are only logged
+func (s *s3Storage) abortMultipart(ctx context.Context, objectKey, uploadID string) {
+	resp, err := s.do(ctx, http.MethodDelete, objectKey, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "s3 abort multipart upload error: %s %s\n", err, objectKey)
+		return
+	}
+	resp.Body.Close()
+}
+
+// delete removes the object, failures are only logged
+func (s *s3Storage) delete(ctx context.Context, key string) {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "s3 delete error: %s %s\n", err, key)
+		return
+	}
+	resp.Body.Close()
+}
+
+func (s *s3Storage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	obj, ok, err := s.head(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return bytes.Equal(obj.outputID, outputID), nil
+}
+
+func (s *s3Storage) Close(_ context.Context) error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// parallel calls fn for consecutive parts of size bytes, at most concurrency at once, returns the first error
+func (s *s3Storage) parallel(size int64, fn func(offset, size int64) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, s.concurrency)
+	for offset := int64(0); offset < size; offset += s.partSize {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(offset int64) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := fn(offset, min(s.partSize, size-offset))
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(offset)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (s *s3Storage) objectKey(key string) string {
+	return path.Join(s.prefix, key)
+}
+
+// do sends a signed request for object key of the bucket, empty key addresses the bucket itself
+func (s *s3Storage) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, key)
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("s3 request error: %w %s", err, key)
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	s.signer.sign(req, s3PayloadHash(body), time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s error: %w %s", strings.ToLower(method), err, key)
+	}
+	return resp, nil
+}
+
+// ifMatch makes request fail if the object was overwritten since etag was seen
+func ifMatch(header http.Header, etag string) http.Header {
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	return header
+}
+
+// decodeS3Response decodes XML body of successful response and closes it
+func decodeS3Response(resp *http.Response, v any) error {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// sign adds AWS Signature Version 4 headers to request with payload of hash
+func (s s3Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" || name == "if-match" || name == "content-type" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + s3PayloadHash([]byte(canonicalRequest))
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func s3PayloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func s3EscapePath(p string) string {
+	return s3Escape(p, false)
+}
+
+// s3Escape encodes everything but unreserved characters of RFC 3986, keeping slashes of paths
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	outputIDHeader = "Gocacheprog-Output-Id"
+	cachePath      = "/cache/"
+	sweepInterval  = time.Minute
+	//shutdownTimeout lets in-flight uploads finish
+	shutdownTimeout = 30 * time.Second
+	//readHeaderTimeout drops clients holding connections without sending a request
+	readHeaderTimeout = 10 * time.Second
+	//evictionWatermark is share of max size left after eviction, so it does not run on every put
+	evictionWatermark = 0.9
+)
+
+var (
+	serveGets          = expvar.NewInt("serve_gets")
+	serveHits          = expvar.NewInt("serve_hits")
+	serveHas           = expvar.NewInt("serve_has")
+	servePuts          = expvar.NewInt("serve_puts")
+	serveErrors        = expvar.NewInt("serve_errors")
+	serveUnauthorized  = expvar.NewInt("serve_unauthorized")
+	serveBytesSent     = expvar.NewInt("serve_bytes_sent")
+	serveBytesReceived = expvar.NewInt("serve_bytes_received")
+	serveCacheBytes    = expvar.NewInt("serve_cache_bytes")
+	serveEvictedFiles  = expvar.NewInt("serve_evicted_files")
+	serveEvictedBytes  = expvar.NewInt("serve_evicted_bytes")
+	//keys are hex ActionIDs or dictionary keys, anything else could escape the cache dir
+	validKey = regexp.MustCompile(`^[0-9A-Za-z_-]+$`)
+)
+
+type (
+	// cacheHandler serves storage over HTTP:
+	//
+	//	GET /cache/<key> - body with OutputID in Gocacheprog-Output-Id header, 404 if absent
+	//	HEAD /cache/<key> with Gocacheprog-Output-Id header - 200 if key is stored with the OutputID, 404 otherwise
+	//	PUT /cache/<key> with Gocacheprog-Output-Id header - stores body
+	cacheHandler struct {
+		storage Storage
+		//tokens are accepted bearer tokens, every request is accepted if empty
+		tokens []string
+		stats  *serverStats
+	}
+	// evictingStorage keeps size of a file system storage dir under a cap,
+	// removing least recently used files, hits refresh modification time of their files
+	evictingStorage struct {
+		Storage
+		dir     string
+		maxSize int64
+		size    atomic.Int64
+		sweeps  chan struct{}
+		ready   atomic.Bool
+		stop    chan struct{}
+		done    sync.WaitGroup
+		mu      sync.Mutex
+		stats   dirStats
+	}
+	cacheFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+)
+
+func NewCacheHandler(storage Storage, tokens []string, stats *serverStats) *cacheHandler {
+	return &cacheHandler{storage: storage, tokens: tokens, stats: stats}
+}
+
+func (h *cacheHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		serveUnauthorized.Add(1)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w := &statusWriter{ResponseWriter: rw}
+	defer h.stats.observe(r, w)
+	key := strings.TrimPrefix(r.URL.Path, cachePath)
+	if !validKey.MatchString(key) {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	outputID, err := hex.DecodeString(r.Header.Get(outputIDHeader))
+	if err != nil {
+		http.Error(w, "invalid output id", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		serveGets.Add(1)
+		err = h.get(w, r, key)
+	case http.MethodHead:
+		serveHas.Add(1)
+		err = h.has(w, r, key, outputID)
+	case http.MethodPut:
+		servePuts.Add(1)
+		err = h.put(w, r, key, outputID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		serveErrors.Add(1)
+		h.stats.fail(r, key, err)
+		fmt.Fprintf(os.Stderr, "serve %s %s: %s\n", r.Method, key, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// authorized accepts a token as bearer or, for browsers opening the dashboard, as basic auth password
+func (h *cacheHandler) authorized(r *http.Request) bool {
+	if len(h.tokens) == 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, token, ok = r.BasicAuth()
+	}
+	if !ok {
+		return false
+	}
+	for _, t := range h.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *cacheHandler) get(w http.ResponseWriter, r *http.Request, key string) error {
+	resp, ok, err := h.storage.Get(r.Context(), key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return nil
+	}
+	defer discardBody(resp.Body)
+	body := resp.Body
+	if resp.DiskPath != "" {
+		f, err := os.Open(resp.DiskPath)
+		if errors.Is(err, os.ErrNotExist) {
+			//evicted after lookup
+			http.NotFound(w, r)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		body = f
+	}
+	serveHits.Add(1)
+	w.Header().Set(outputIDHeader, hex.EncodeToString(resp.OutputID))
+	w.Header().Set("Content-Length", strconv.FormatInt(resp.BodySize, 10))
+	n, _ := io.Copy(w, body)
+	serveBytesSent.Add(n)
+	return nil
+}
+
+func (h *cacheHandler) has(w http.ResponseWriter, r *http.Request, key string, outputID []byte) error {
+	ok, err := h.storage.Has(r.Context(), key, outputID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+	}
+	return nil
+}
+
+func (h *cacheHandler) put(w http.ResponseWriter, r *http.Request, key string, outputID []byte) error {
+	if r.ContentLength < 0 {
+		http.Error(w, "length required", http.StatusLengthRequired)
+		return nil
+	}
+	_, err := h.storage.Put(r.Context(), PutRequest{
+		Key:      key,
+		OutputID: outputID,
+		Body:     r.Body,
+		BodySize: r.ContentLength,
+	})
+	if err != nil {
+		return err
+	}
+	serveBytesReceived.Add(r.ContentLength)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// NewEvictingStorage wraps storage keeping files in dir, evicting them in background above maxSize,
+// 0 disables eviction
+func NewEvictingStorage(storage Storage, dir string, maxSize int64) *evictingStorage {
+	e := &evictingStorage{
+		Storage: storage,
+		dir:     dir,
+		maxSize: maxSize,
+		sweeps:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	e.done.Add(1)
+	go e.run()
+	return e
+}
+
+func (e *evictingStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	resp, ok, err := e.Storage.Get(ctx, key)
+	//indexed storage keeps access time of its entries itself
+	if _, indexed := e.Storage.(*indexedStorage); ok && resp.DiskPath != "" && !indexed {
+		now := time.Now()
+		os.Chtimes(resp.DiskPath, now, now)
+		os.Chtimes(fileSystemStorage{dir: e.dir}.indexName(key), now, now)
+	}
+	return resp, ok, err
+}
+
+func (e *evictingStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	diskPath, err := e.Storage.Put(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	//deduplicated bodies are counted as well, next sweep corrects the size
+	if e.maxSize > 0 && e.size.Add(request.BodySize) > e.maxSize {
+		select {
+		case e.sweeps <- struct{}{}:
+		default:
+		}
+	}
+	return diskPath, nil
+}
+
+func (e *evictingStorage) Close(ctx context.Context) error {
+	close(e.stop)
+	e.done.Wait()
+	return e.Storage.Close(ctx)
+}
+
+// run sweeps dir on start, periodically and when puts exceed max size
+func (e *evictingStorage) run() {
+	defer e.done.Done()
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		err := e.sweep()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to sweep %s: %s\n", e.dir, err)
+		}
+		e.ready.Store(err == nil)
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		case <-e.sweeps:
+		}
+	}
+}
+
+// sweep measures dir and removes least recently used files down to the watermark if it exceeds max size
+func (e *evictingStorage) sweep() error {
+	if indexed, ok := e.Storage.(*indexedStorage); ok {
+		return e.sweepIndex(indexed)
+	}
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+	var files []cacheFile
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cacheFile{path: path.Join(e.dir, entry.Name()), size: info.Size(), modTime: info.ModTime()})
+		total += info.Size()
+	}
+	if e.maxSize > 0 && total > e.maxSize {
+		sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+		target := int64(float64(e.maxSize) * evictionWatermark)
+		//an index left without its body is a miss, a body left without its index is evicted later
+		for i, f := range files {
+			if total <= target {
+				break
+			}
+			if os.Remove(f.path) == nil {
+				total -= f.size
+				files[i].path = ""
+				serveEvictedFiles.Add(1)
+				serveEvictedBytes.Add(f.size)
+			}
+		}
+	}
+	e.size.Store(total)
+	serveCacheBytes.Set(total)
+	e.measure(files)
+	return nil
+}
+
+// measure counts entries and keeps the largest bodies among files left by sweep
+func (e *evictingStorage) measure(files []cacheFile) {
+	var stats dirStats
+	for _, f := range files {
+		switch {
+		case f.path == "":
+		case strings.HasSuffix(f.path, "-i"):
+			stats.Entries++
+		case strings.HasSuffix(f.path, "-d") || strings.HasSuffix(f.path, "-o"):
+			stats.Bodies++
+			stats.Largest = append(stats.Largest, cacheEntry{Name: path.Base(f.path), Size: f.size, ModTime: f.modTime})
+		}
+	}
+	e.setStats(stats)
+}
+
+// sweepIndex is sweep taking entries and access times from the index, entries of index files written without it
+// are added first. Bodies shared by several entries are evicted with all of them once the most recently used one
+// is the oldest left
+func (e *evictingStorage) sweepIndex(indexed *indexedStorage) error {
+	type body struct {
+		name  string
+		size  int64
+		atime time.Time
+		keys  []string
+	}
+	names, err := indexed.backfillDir()
+	if err != nil {
+		return err
+	}
+	bodies := map[string]*body{}
+	var stats dirStats
+	err = indexed.each(func(key string, entry indexEntry) {
+		stats.Entries++
+		b, ok := bodies[entry.Body]
+		if !ok {
+			b = &body{name: entry.Body, size: entry.Size}
+			bodies[entry.Body] = b
+		}
+		b.keys = append(b.keys, key)
+		if entry.Atime.After(b.atime) {
+			b.atime = entry.Atime
+		}
+	})
+	if err != nil {
+		return err
+	}
+	//bodies left without entries, e.g. being written or after a failed removal, are evicted by modification time
+	for _, name := range names {
+		if _, ok := bodies[name]; ok {
+			continue
+		}
+		info, err := os.Stat(path.Join(e.dir, name))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		bodies[name] = &body{name: name, size: info.Size(), atime: info.ModTime()}
+	}
+	var total int64
+	sorted := make([]*body, 0, len(bodies))
+	for _, b := range bodies {
+		sorted = append(sorted, b)
+		total += b.size
+	}
+	if e.maxSize > 0 && total > e.maxSize {
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].atime.Before(sorted[j].atime) })
+		target := int64(float64(e.maxSize) * evictionWatermark)
+		for i, b := range sorted {
+			if total <= target {
+				break
+			}
+			if indexed.remove(b.keys...) != nil {
+				continue
+			}
+			os.Remove(path.Join(e.dir, b.name))
+			total -= b.size
+			stats.Entries -= int64(len(b.keys))
+			sorted[i] = nil
+			serveEvictedFiles.Add(int64(len(b.keys)) + 1)
+			serveEvictedBytes.Add(b.size)
+		}
+	}
+	for _, b := range sorted {
+		if b != nil {
+			stats.Bodies++
+			stats.Largest = append(stats.Largest, cacheEntry{Name: b.name, Size: b.size, ModTime: b.atime})
+		}
+	}
+	e.size.Store(total)
+	serveCacheBytes.Set(total)
+	e.setStats(stats)
+	return nil
+}
+
+// setStats keeps stats with the largest bodies first
+func (e *evictingStorage) setStats(stats dirStats) {
+	sort.Slice(stats.Largest, func(i, j int) bool { return stats.Largest[i].Size > stats.Largest[j].Size })
+	stats.Largest = stats.Largest[:min(len(stats.Largest), statsTopN)]
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.stats = stats
+}
+
+// dirStats returns stats measured by the last sweep with the current size
+func (e *evictingStorage) dirStats() dirStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stats := e.stats
+	stats.Size, stats.MaxSize = e.size.Load(), e.maxSize
+	if stats.Largest == nil {
+		stats.Largest = []cacheEntry{}
+	}
+	return stats
+}
+
+// parseSize parses size in bytes with optional KB, MB, GB or TB suffix of powers of 1024
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if number, ok := strings.CutSuffix(s, suffix); ok {
+			s, multiplier = strings.TrimSpace(number), int64(1)<<(10*(i+1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return n * multiplier, nil
+}
+
+// requireToken asks browsers for the token in a basic auth prompt
+func (h *cacheHandler) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.authorized(r) {
+			serveUnauthorized.Add(1)
+			w.Header().Set("WWW-Authenticate", `Basic realm="gocacheprog"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// newServeMux routes cache requests to handler and the dashboard to its stats,
+// health, readiness and expvar counters are served without auth
+func newServeMux(handler *cacheHandler, ready func() bool) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(cachePath, handler)
+	mux.HandleFunc("GET /{$}", handler.requireToken(handler.stats.serveDashboard))
+	mux.HandleFunc("GET /stats", handler.requireToken(handler.stats.serveStats))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", serveCounters)
+	return mux
+}
+
+// runServe serves -dir until interrupted, readiness fails during graceful shutdown
+func runServe() {
+	if *dir == "" {
+		flag.Usage()
+		log.Fatal("dir is required")
+	}
+	size, err := parseSize(*maxSize)
+	if err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	evicting := NewEvictingStorage(localStorage(), *dir, size)
+	//metrics are printed on shutdown and feed the dashboard
+	storage := NewMetricsStorage(evicting).(*metrics)
+	defer storage.Close(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	stats := newServerStats(storage, evicting)
+	go stats.run(ctx)
+	var shuttingDown atomic.Bool
+	server := &http.Server{
+		Addr: *listen,
+		Handler: newServeMux(NewCacheHandler(storage, loadServerTokens(), stats), func() bool {
+			return evicting.ready.Load() && !shuttingDown.Load()
+		}),
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shuttingDown.Store(true)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", *dir, *listen)
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("failed to serve: %s", err)
+	}
+	//ListenAndServe returns as soon as shutdown starts, in-flight requests finish before it ends
+	<-shutdown
+}
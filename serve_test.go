@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Serve(t *testing.T) {
+	ctx := context.Background()
+	newServer := func(t *testing.T, ready func() bool) *httptest.Server {
+		server, _ := newTestServer(t, ready)
+		return server
+	}
+	t.Run("round trip through server storage", func(t *testing.T) {
+		server := newServer(t, func() bool { return true })
+		storage := must(NewServerStorage(server.Client(), HTTPOptions{URL: server.URL, Token: "secret"}))
+		if err := storage.(*serverStorage).ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+		_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get, ok, err := storage.Get(ctx, "ActionID_1")
+		if err != nil || !ok {
+			t.Fatal("expected to be found", err)
+		}
+		if string(get.OutputID) != "OutputID_1" || get.BodySize != 5 || string(must(io.ReadAll(get.Body))) != "hello" {
+			t.Fatal("expected stored entry")
+		}
+		has, err := storage.Has(ctx, "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have entry", err)
+		}
+		has, err = storage.Has(ctx, "ActionID_1", []byte("OutputID_2"))
+		if err != nil || has {
+			t.Fatal("expected not to have entry of other output", err)
+		}
+		_, ok, err = storage.Get(ctx, "ActionID_2")
+		if err != nil || ok {
+			t.Fatal("expected miss", err)
+		}
+	})
+	t.Run("token is required", func(t *testing.T) {
+		server := newServer(t, func() bool { return true })
+		storage := must(NewServerStorage(server.Client(), HTTPOptions{URL: server.URL, Token: "wrong"}))
+		if err := storage.(*serverStorage).ping(ctx); err == nil {
+			t.Fatal("expected unauthorized")
+		}
+		storage = must(NewServerStorage(server.Client(), HTTPOptions{URL: server.URL, Token: "old"}))
+		if err := storage.(*serverStorage).ping(ctx); err != nil {
+			t.Fatal("expected any of tokens to be accepted", err)
+		}
+	})
+	t.Run("key must not escape dir", func(t *testing.T) {
+		server := newServer(t, func() bool { return true })
+		req := must(http.NewRequest(http.MethodGet, server.URL+"/cache/..%2Fsecret", nil))
+		req.Header.Set("Authorization", "Bearer secret")
+		resp := must(server.Client().Do(req))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("expected bad request, got %s", resp.Status)
+		}
+	})
+	t.Run("metrics leave out command line", func(t *testing.T) {
+		server := newServer(t, func() bool { return true })
+		resp := must(server.Client().Get(server.URL + "/metrics"))
+		defer resp.Body.Close()
+		var counters map[string]any
+		must0(json.NewDecoder(resp.Body).Decode(&counters))
+		if _, ok := counters["cmdline"]; ok {
+			t.Fatal("expected command line to be left out")
+		}
+		if _, ok := counters["serve_gets"]; !ok {
+			t.Fatal("expected counters")
+		}
+	})
+	t.Run("health and readiness", func(t *testing.T) {
+		ready := false
+		server := newServer(t, func() bool { return ready })
+		for p, code := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable, "/metrics": http.StatusOK} {
+			resp := must(server.Client().Get(server.URL + p))
+			resp.Body.Close()
+			if resp.StatusCode != code {
+				t.Fatalf("expected %d of %s, got %s", code, p, resp.Status)
+			}
+		}
+		ready = true
+		resp := must(server.Client().Get(server.URL + "/readyz"))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected ready, got %s", resp.Status)
+		}
+	})
+}
+
+func Test_Dashboard(t *testing.T) {
+	ctx := context.Background()
+	server, stats := newTestServer(t, func() bool { return true })
+	storage := must(NewServerStorage(server.Client(), HTTPOptions{URL: server.URL, Token: "secret"}))
+	_, err := storage.Put(ctx, PutRequest{Key: "ActionID_1", OutputID: []byte("OutputID_1"), Body: strings.NewReader("hello"), BodySize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"ActionID_1", "ActionID_2"} {
+		if _, _, err := storage.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats.sample(time.Now())
+	stats.evicting.sweep()
+
+	req := must(http.NewRequest(http.MethodGet, server.URL+"/stats", nil))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp := must(server.Client().Do(req))
+	defer resp.Body.Close()
+	var s statsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Storage.Gets != 2 || s.Storage.Misses != 1 || s.Storage.Puts != 1 {
+		t.Fatalf("unexpected storage counters %+v", s.Storage)
+	}
+	if len(s.History) != 1 || s.History[0].Gets != 2 || s.History[0].Misses != 1 {
+		t.Fatalf("unexpected history %+v", s.History)
+	}
+	if len(s.Clients) != 1 || s.Clients[0].Client != "127.0.0.1" || s.Clients[0].Hits != 1 ||
+		s.Clients[0].BytesReceived != 5 || s.Clients[0].BytesSent < 5 {
+		t.Fatalf("unexpected clients %+v", s.Clients)
+	}
+	//bodies are copied from files, which keeps sendfile only if the writer is a ReaderFrom
+	if _, ok := any(&statusWriter{}).(io.ReaderFrom); !ok {
+		t.Fatal("expected status writer to be a ReaderFrom")
+	}
+	if s.Dir.Entries != 1 || len(s.Dir.Largest) != 1 || s.Dir.Largest[0].Size != 5 {
+		t.Fatalf("unexpected dir stats %+v", s.Dir)
+	}
+	if s.Counters["serve_hits"] == 0 {
+		t.Fatal("expected expvar counters")
+	}
+
+	resp = must(server.Client().Get(server.URL + "/"))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected basic auth prompt, got %s", resp.Status)
+	}
+	req = must(http.NewRequest(http.MethodGet, server.URL+"/", nil))
+	req.SetBasicAuth("", "secret")
+	resp = must(server.Client().Do(req))
+	page := string(must(io.ReadAll(resp.Body)))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(page, "fetch('stats')") {
+		t.Fatalf("expected dashboard, got %s", resp.Status)
+	}
+}
+
+// newTestServer serves storage of a temporary dir the way runServe does, without background loops
+func newTestServer(t *testing.T, ready func() bool) (*httptest.Server, *serverStats) {
+	dir := t.TempDir()
+	evicting := &evictingStorage{Storage: NewFileSystemStorage(dir, false), dir: dir, sweeps: make(chan struct{}, 1)}
+	storage := NewMetricsStorage(evicting).(*metrics)
+	stats := newServerStats(storage, evicting)
+	server := httptest.NewServer(newServeMux(NewCacheHandler(storage, []string{"old", "secret"}, stats), ready))
+	t.Cleanup(server.Close)
+	return server, stats
+}
+
+func Test_EvictingStorage(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	//background loop is not started, sweeps are run by the test
+	storage := &evictingStorage{Storage: NewFileSystemStorage(dir, false), dir: dir, sweeps: make(chan struct{}, 1)}
+	for _, key := range []string{"ActionID_1", "ActionID_2", "ActionID_3"} {
+		_, err := storage.Put(ctx, PutRequest{Key: key, OutputID: []byte("OutputID_" + key), Body: strings.NewReader(strings.Repeat("a", 400)), BodySize: 400})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	//ActionID_1 is older than ActionID_2 but is used afterwards
+	for i, key := range []string{"ActionID_1", "ActionID_2"} {
+		old := time.Now().Add(-time.Duration(i+1) * time.Hour)
+		fs := fileSystemStorage{dir: dir}
+		os.Chtimes(fs.indexName(key), old, old)
+		os.Chtimes(fs.bodyName(key, []byte("OutputID_"+key)), old, old)
+	}
+	_, ok, err := storage.Get(ctx, "ActionID_1")
+	if err != nil || !ok {
+		t.Fatal("expected to be found", err)
+	}
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	total := storage.size.Load()
+	storage.maxSize = total - 1
+	if err := storage.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]bool{"ActionID_1": true, "ActionID_2": false, "ActionID_3": true} {
+		_, ok, err := storage.Get(ctx, key)
+		if err != nil || ok != expected {
+			t.Fatalf("expected %s to be found: %v, %v", key, expected, err)
+		}
+	}
+	if storage.size.Load() > int64(float64(total)*evictionWatermark) {
+		t.Fatalf("expected size below watermark, got %d of %d", storage.size.Load(), total)
+	}
+}
+
+func Test_ParseSize(t *testing.T) {
+	for s, expected := range map[string]int64{"0": 0, "100": 100, "2KB": 2048, "50 GB": 50 << 30, "1tb": 1 << 40} {
+		if size, err := parseSize(s); err != nil || size != expected {
+			t.Fatalf("expected %d of %s, got %d %v", expected, s, size, err)
+		}
+	}
+	if _, err := parseSize("-1MB"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// serverStorage talks to a gocacheprog serve instance, bodies are stored and deduplicated by its file system storage
+type serverStorage struct {
+	*httpEndpoint
+}
+
+func NewServerStorage(client *http.Client, options HTTPOptions) (Storage, error) {
+	endpoint, err := newHTTPEndpoint(client, options)
+	if err != nil {
+		return nil, err
+	}
+	return &serverStorage{httpEndpoint: endpoint}, nil
+}
+
+// ping checks the server is reachable and the token is accepted
+func (s *serverStorage) ping(ctx context.Context) error {
+	_, err := s.Has(ctx, "ping", nil)
+	return err
+}
+
+func (s *serverStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	if strings.TrimSpace(key) == "" {
+		return GetResponse{}, false, fmt.Errorf("empty key")
+	}
+	resp, err := s.do(ctx, http.MethodGet, cachePath+key, nil, nil, 0)
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("server get error: %w %s", err, key)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return GetResponse{}, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return GetResponse{}, false, fmt.Errorf("server get error: %s %s", resp.Status, key)
+	}
+	outputID, err := hex.DecodeString(resp.Header.Get(outputIDHeader))
+	if err != nil {
+		resp.Body.Close()
+		return GetResponse{}, false, fmt.Errorf("server get error: invalid output id %w %s", err, key)
+	}
+	return GetResponse{
+		OutputID: outputID,
+		BodySize: resp.ContentLength,
+		Body:     &streamBody{storage: "server", key: key, body: resp.Body},
+	}, true, nil
+}
+
+func (s *serverStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	//body is rewound on retries
+	body, ok := request.Body.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(request.Body)
+		if err != nil {
+			return "", fmt.Errorf("server bodyReadAll error: %w %s", err, request.Key)
+		}
+		body = bytes.NewReader(b)
+	}
+	header := http.Header{outputIDHeader: {hex.EncodeToString(request.OutputID)}}
+	resp, err := s.do(ctx, http.MethodPut, cachePath+request.Key, header, body, request.BodySize)
+	if err != nil {
+		return "", fmt.Errorf("server put error: %w %s", err, request.Key)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("server put error: %s %s", resp.Status, request.Key)
+	}
+	//no disk path to return
+	return "", nil
+}
+
+func (s *serverStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	header := http.Header{outputIDHeader: {hex.EncodeToString(outputID)}}
+	resp, err := s.do(ctx, http.MethodHead, cachePath+key, header, nil, 0)
+	if err != nil {
+		return false, fmt.Errorf("server has error: %w %s", err, key)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("server has error: %s %s", resp.Status, key)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// signed value is magic, version, key ID, signature, uvarint OutputID length, OutputID, then body.
+// Signature covers ActionID, OutputID and body hash, so an entry can't be moved to another action.
+var signMagic = []byte("GCPS")
+
+const (
+	signVersion   = 1
+	signKeyIDSize = 8
+)
+
+var (
+	signRejected   = expvar.NewInt("sign_rejected")
+	signPutDropped = expvar.NewInt("sign_put_dropped")
+)
+
+type (
+	// signStorage signs entries on the way to the decorated storage and accepts only entries signed by trusted keys,
+	// without signing key it only reads.
+	// Decorated storage sees OutputIDs bound to ActionID, as a shared blob would carry signature of another action.
+	signStorage struct {
+		Storage
+		signer  ed25519.PrivateKey
+		trusted map[string]ed25519.PublicKey
+	}
+)
+
+// NewSignStorage signs with signer, nil signer drops puts, trusted are public keys accepted on get
+func NewSignStorage(storage Storage, signer ed25519.PrivateKey, trusted []ed25519.PublicKey) Storage {
+	s := &signStorage{Storage: storage, signer: signer, trusted: map[string]ed25519.PublicKey{}}
+	for _, key := range trusted {
+		s.trusted[signKeyID(key)] = key
+	}
+	if signer != nil {
+		public := signer.Public().(ed25519.PublicKey)
+		s.trusted[signKeyID(public)] = public
+	}
+	return s
+}
+
+func (s signStorage) Get(ctx context.Context, key string) (GetResponse, bool, error) {
+	getResponse, ok, err := s.Storage.Get(ctx, key)
+	if err != nil || !ok {
+		return GetResponse{}, ok, err
+	}
+	src, err := readBody(getResponse.Body)
+	if errors.Is(err, errCorruptedBody) {
+		//detected and reported by the decorated storage while streaming
+		return GetResponse{}, false, nil
+	}
+	if err != nil {
+		return GetResponse{}, false, fmt.Errorf("get: read body: %w", err)
+	}
+	outputID, body, err := s.open(key, src)
+	if err == nil && !bytes.Equal(getResponse.OutputID, boundOutputID(key, outputID)) {
+		err = errors.New("entry is bound to another output")
+	}
+	if err != nil {
+		signRejected.Add(1)
+		fmt.Fprintf(os.Stderr, "sign: rejected %s: %s\n", key, err)
+		return GetResponse{}, false, nil
+	}
+	return GetResponse{
+		OutputID: outputID,
+		DiskPath: getResponse.DiskPath,
+		BodySize: int64(len(body)),
+		Body:     bytes.NewReader(body),
+	}, true, nil
+}
+
+func (s signStorage) Put(ctx context.Context, request PutRequest) (string, error) {
+	if s.signer == nil {
+		signPutDropped.Add(1)
+		return "", errPutDropped
+	}
+	src, err := io.ReadAll(request.Body)
+	if err != nil {
+		return "", fmt.Errorf("put: read body: %w", err)
+	}
+	body := s.seal(request.Key, request.OutputID, src)
+	return s.Storage.Put(ctx, PutRequest{
+		Key:      request.Key,
+		OutputID: boundOutputID(request.Key, request.OutputID),
+		Body:     bytes.NewReader(body),
+		BodySize: int64(len(body)),
+	})
+}
+
+// Has checks the signature, as anyone can store an entry under the bound OutputID
+// to keep trusted writers from uploading the real one
+func (s signStorage) Has(ctx context.Context, key string, outputID []byte) (bool, error) {
+	getResponse, ok, err := s.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return bytes.Equal(getResponse.OutputID, outputID), nil
+}
+
+func (s signStorage) Close(ctx context.Context) error {
+	return s.Storage.Close(ctx)
+}
+
+func (s signStorage) seal(key string, outputID, body []byte) []byte {
+	dst := append([]byte{}, signMagic...)
+	dst = append(dst, signVersion)
+	dst = append(dst, signKeyID(s.signer.Public().(ed25519.PublicKey))...)
+	dst = append(dst, ed25519.Sign(s.signer, signedMessage(key, outputID, body))...)
+	dst = binary.AppendUvarint(dst, uint64(len(outputID)))
+	dst = append(dst, outputID...)
+	return append(dst, body...)
+}
+
+func (s signStorage) open(key string, src []byte) (outputID, body []byte, err error) {
+	if !bytes.HasPrefix(src, signMagic) {
+		return nil, nil, errors.New("entry is not signed")
+	}
+	src = src[len(signMagic):]
+	if len(src) < 1+signKeyIDSize+ed25519.SignatureSize || src[0] != signVersion {
+		return nil, nil, errors.New("unsupported signed entry")
+	}
+	id, signature, src := string(src[1:1+signKeyIDSize]), src[1+signKeyIDSize:1+signKeyIDSize+ed25519.SignatureSize], src[1+signKeyIDSize+ed25519.SignatureSize:]
+	public, ok := s.trusted[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("untrusted key %x", id)
+	}
+	n, l := binary.Uvarint(src)
+	if l <= 0 || uint64(len(src)-l) < n {
+		return nil, nil, errors.New("truncated signed entry")
+	}
+	outputID, body = src[l:l+int(n)], src[l+int(n):]
+	if !ed25519.Verify(public, signedMessage(key, outputID, body), signature) {
+		return nil, nil, fmt.Errorf("invalid signature of key %x", id)
+	}
+	return outputID, body, nil
+}
+
+func signedMessage(key string, outputID, body []byte) []byte {
+	message := []byte("gocacheprog signed entry\x00")
+	message = binary.AppendUvarint(message, uint64(len(key)))
+	message = append(message, key...)
+	message = binary.AppendUvarint(message, uint64(len(outputID)))
+	message = append(message, outputID...)
+	return append(message, contentHash(body)...)
+}
+
+// boundOutputID is what decorated storage stores instead of OutputID, unique for every action
+func boundOutputID(key string, outputID []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(outputID)
+	return h.Sum(nil)
+}
+
+func signKeyID(public ed25519.PublicKey) string {
+	sum := sha256.Sum256(public)
+	return string(sum[:signKeyIDSize])
+}
+
+// loadSigner parses base64 of ed25519 seed
+func loadSigner(r io.Reader) (ed25519.PrivateKey, error) {
+	encoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key: expected %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// loadTrustedKeys parses lines of base64 ed25519 public keys,
+// empty lines and lines starting with # are skipped
+func loadTrustedKeys(r io.Reader) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted key: %w", err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid trusted key: expected %d bytes, got %d", ed25519.PublicKeySize, len(key))
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// signKeyDescription is printed by sign-keygen
+func signKeyDescription(signer ed25519.PrivateKey) string {
+	public := signer.Public().(ed25519.PublicKey)
+	return fmt.Sprintf("signing key (keep secret): %s\ntrusted key: %s\nkey id: %s\n",
+		base64.StdEncoding.EncodeToString(signer.Seed()),
+		base64.StdEncoding.EncodeToString(public),
+		hex.EncodeToString([]byte(signKeyID(public))))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func Test_SignStorage(t *testing.T) {
+	_, trustedSigner := must2(ed25519.GenerateKey(nil))
+	_, untrustedSigner := must2(ed25519.GenerateKey(nil))
+	trusted := []ed25519.PublicKey{trustedSigner.Public().(ed25519.PublicKey)}
+	body := strings.Repeat("MinRana", 10)
+	put := func(t *testing.T, storage Storage, key string) {
+		_, err := storage.Put(context.Background(), PutRequest{
+			Key: key, OutputID: []byte("OutputID_1"), Body: strings.NewReader(body), BodySize: int64(len(body)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(t *testing.T, storage Storage, key string) (GetResponse, bool) {
+		getResponse, ok, err := storage.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return getResponse, ok
+	}
+	t.Run("trusted entry is read by reader", func(t *testing.T) {
+		external := newMemoryStorage()
+		put(t, NewSignStorage(external, trustedSigner, nil), "ActionID_1")
+		getResponse, ok := get(t, NewSignStorage(external, nil, trusted), "ActionID_1")
+		if !ok {
+			t.Fatal("expected to be found")
+		}
+		if string(getResponse.OutputID) != "OutputID_1" || string(must(io.ReadAll(getResponse.Body))) != body {
+			t.Fatal("expected to be equal")
+		}
+		has, err := NewSignStorage(external, nil, trusted).Has(context.Background(), "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have", err)
+		}
+	})
+	t.Run("untrusted and unsigned entries are missed", func(t *testing.T) {
+		external := newMemoryStorage()
+		put(t, NewSignStorage(external, untrustedSigner, nil), "ActionID_1")
+		put(t, external, "ActionID_2")
+		rejected := signRejected.Value()
+		for _, key := range []string{"ActionID_1", "ActionID_2"} {
+			if _, ok := get(t, NewSignStorage(external, nil, trusted), key); ok {
+				t.Fatal("expected to be missing", key)
+			}
+		}
+		if signRejected.Value()-rejected < 2 {
+			t.Fatal("expected rejections to be counted")
+		}
+	})
+	t.Run("entry moved to another action is missed", func(t *testing.T) {
+		external := newMemoryStorage()
+		put(t, NewSignStorage(external, trustedSigner, nil), "ActionID_1")
+		external.bodies["ActionID_2"] = external.bodies["ActionID_1"]
+		external.index["ActionID_2"] = external.index["ActionID_1"]
+		if _, ok := get(t, NewSignStorage(external, nil, trusted), "ActionID_2"); ok {
+			t.Fatal("expected to be missing")
+		}
+	})
+	t.Run("planted entry is not had", func(t *testing.T) {
+		external := newMemoryStorage()
+		_, err := external.Put(context.Background(), PutRequest{
+			Key: "ActionID_1", OutputID: boundOutputID("ActionID_1", []byte("OutputID_1")), Body: strings.NewReader("garbage"), BodySize: 7,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		storage := NewSignStorage(external, trustedSigner, nil)
+		has, err := storage.Has(context.Background(), "ActionID_1", []byte("OutputID_1"))
+		if err != nil || has {
+			t.Fatal("expected not to have planted entry", err)
+		}
+		put(t, storage, "ActionID_1")
+		has, err = storage.Has(context.Background(), "ActionID_1", []byte("OutputID_1"))
+		if err != nil || !has {
+			t.Fatal("expected to have entry uploaded over planted one", err)
+		}
+	})
+	t.Run("reader drops puts", func(t *testing.T) {
+		external := newMemoryStorage()
+		_, err := NewSignStorage(external, nil, trusted).Put(context.Background(), PutRequest{Key: "ActionID_1", Body: strings.NewReader(body)})
+		if !errors.Is(err, errPutDropped) {
+			t.Fatal("expected put to be reported as dropped", err)
+		}
+		if len(external.bodies) != 0 {
+			t.Fatal("expected put to be dropped")
+		}
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// detectToolchain returns namespace of the invoking go toolchain like go1.24.4-linux-amd64,
+// taken from GOVERSION, GOOS and GOARCH if all of them are set, otherwise asked from go env
+func detectToolchain() (string, error) {
+	values := []string{os.Getenv("GOVERSION"), os.Getenv("GOOS"), os.Getenv("GOARCH")}
+	if values[0] == "" || values[1] == "" || values[2] == "" {
+		goBin := "go"
+		//go command passes GOROOT of the toolchain to its children
+		if goroot := os.Getenv("GOROOT"); goroot != "" {
+			goBin = filepath.Join(goroot, "bin", "go")
+		}
+		out, err := exec.Command(goBin, "env", "GOVERSION", "GOOS", "GOARCH").Output()
+		if err != nil {
+			return "", fmt.Errorf("go env: %w", err)
+		}
+		values = strings.Fields(string(out))
+		if len(values) != 3 {
+			return "", fmt.Errorf("unexpected go env output: %q", out)
+		}
+	}
+	return strings.Join(values, "-"), nil
+}
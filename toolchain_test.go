@@ -0,0 +1,27 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_DetectToolchain(t *testing.T) {
+	t.Run("taken from environment", func(t *testing.T) {
+		t.Setenv("GOVERSION", "go1.24.4")
+		t.Setenv("GOOS", "linux")
+		t.Setenv("GOARCH", "amd64")
+		if namespace, err := detectToolchain(); err != nil || namespace != "go1.24.4-linux-amd64" {
+			t.Fatalf("expected go1.24.4-linux-amd64, got %s %v", namespace, err)
+		}
+	})
+	t.Run("asked from go env", func(t *testing.T) {
+		t.Setenv("GOVERSION", "")
+		namespace, err := detectToolchain()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parts := strings.Split(namespace, "-"); len(parts) < 3 || !strings.HasPrefix(parts[0], "go") {
+			t.Fatalf("expected go version, GOOS and GOARCH, got %s", namespace)
+		}
+	})
+}